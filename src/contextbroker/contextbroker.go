@@ -0,0 +1,147 @@
+// Package contextbroker holds the parts of the context packet validator that
+// other Go programs can build on: the Issue type that every check reports,
+// the Check interface with its registry, and a curated set of checks that the
+// validate_packet command also exposes through --check.
+package contextbroker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Issue is one finding about a packet. Issues without a Severity are errors;
+// warnings never make a packet invalid.
+type Issue struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Path     string `json:"path,omitempty"`
+	Severity string `json:"severity,omitempty"`
+}
+
+const (
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// Check is a custom validation step. The validator runs checks after its
+// built-in ones, in order, and passes the packet after transforms and
+// defaults. A Check must not modify the packet.
+type Check interface {
+	Run(packet map[string]any, now time.Time) []Issue
+}
+
+// CheckFunc adapts a function to the Check interface.
+type CheckFunc func(packet map[string]any, now time.Time) []Issue
+
+func (f CheckFunc) Run(packet map[string]any, now time.Time) []Issue { return f(packet, now) }
+
+var (
+	mu         sync.Mutex
+	registered []Check
+)
+
+// Register adds c to the checks returned by Registered, which the
+// validate_packet command runs on every packet. Register from init so the
+// check is in place before validation starts.
+func Register(c Check) {
+	mu.Lock()
+	defer mu.Unlock()
+	registered = append(registered, c)
+}
+
+// Registered returns the registered checks in registration order.
+func Registered() []Check {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Check(nil), registered...)
+}
+
+// Run runs checks on packet in order and collects their issues.
+func Run(checks []Check, packet map[string]any, now time.Time) []Issue {
+	var issues []Issue
+	for _, c := range checks {
+		issues = append(issues, c.Run(packet, now)...)
+	}
+	return issues
+}
+
+// curated are the checks that can be named on the command line, each built
+// from its NAME=ARG argument.
+var curated = map[string]func(arg string) (Check, error){
+	"context-id-prefix": func(prefix string) (Check, error) { return ContextIDPrefix(prefix), nil },
+	"require-field": func(field string) (Check, error) {
+		if field == "" {
+			return nil, fmt.Errorf("require-field needs a field, as require-field=FIELD")
+		}
+		return RequireField(field), nil
+	},
+}
+
+// Curated returns the names of the curated checks, sorted.
+func Curated() []string {
+	names := make([]string, 0, len(curated))
+	for name := range curated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseCheck builds a curated check from its command-line form, NAME=ARG.
+func ParseCheck(spec string) (Check, error) {
+	name, arg, ok := strings.Cut(spec, "=")
+	build, known := curated[name]
+	if !known {
+		return nil, fmt.Errorf("unknown check %q (known: %s)", name, strings.Join(Curated(), ", "))
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s needs an argument, as %s=VALUE", name, name)
+	}
+	return build(arg)
+}
+
+// ContextIDPrefix requires context_id to start with a team or tenant prefix,
+// failing with CONTEXT_ID_PREFIX otherwise.
+type ContextIDPrefix string
+
+func (p ContextIDPrefix) Run(packet map[string]any, now time.Time) []Issue {
+	id, _ := packet["context_id"].(string)
+	if strings.HasPrefix(id, string(p)) {
+		return nil
+	}
+	return []Issue{{Code: "CONTEXT_ID_PREFIX", Message: fmt.Sprintf("context_id must start with %q", string(p)), Path: "/context_id"}}
+}
+
+// RequireField requires a field, named by its dotted path, that the schema
+// leaves optional, failing with FIELD_MISSING when it is absent.
+type RequireField string
+
+func (f RequireField) Run(packet map[string]any, now time.Time) []Issue {
+	var cur any = packet
+	for _, key := range strings.Split(string(f), ".") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return f.missing()
+		}
+		if cur, ok = obj[key]; !ok {
+			return f.missing()
+		}
+	}
+	return nil
+}
+
+func (f RequireField) missing() []Issue {
+	return []Issue{{Code: "FIELD_MISSING", Message: fmt.Sprintf("%s is required (by --check require-field)", string(f)), Path: pointer(string(f))}}
+}
+
+// pointer converts a dotted field path to a JSON pointer.
+func pointer(path string) string {
+	var b strings.Builder
+	for _, key := range strings.Split(path, ".") {
+		b.WriteString("/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key))
+	}
+	return b.String()
+}
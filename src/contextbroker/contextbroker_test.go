@@ -0,0 +1,51 @@
+package contextbroker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCheck(t *testing.T) {
+	for _, spec := range []string{"nope=x", "require-field", "require-field="} {
+		if _, err := ParseCheck(spec); err == nil {
+			t.Errorf("ParseCheck(%q) succeeded, want an error", spec)
+		}
+	}
+	if _, err := ParseCheck("nope=x"); err == nil || !strings.Contains(err.Error(), "context-id-prefix, require-field") {
+		t.Errorf("unknown check error %v does not list the curated checks", err)
+	}
+
+	c, err := ParseCheck("context-id-prefix=team_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := c.Run(map[string]any{"context_id": "team_001"}, time.Now()); len(issues) != 0 {
+		t.Errorf("prefixed id: issues = %+v", issues)
+	}
+	if issues := c.Run(map[string]any{"context_id": "ctx_001"}, time.Now()); len(issues) != 1 || issues[0].Code != "CONTEXT_ID_PREFIX" {
+		t.Errorf("unprefixed id: issues = %+v, want CONTEXT_ID_PREFIX", issues)
+	}
+}
+
+func TestRequireField(t *testing.T) {
+	check := RequireField("payload.owner")
+	for name, tc := range map[string]struct {
+		packet map[string]any
+		ok     bool
+	}{
+		"present":       {map[string]any{"payload": map[string]any{"owner": "ops"}}, true},
+		"null":          {map[string]any{"payload": map[string]any{"owner": nil}}, true},
+		"absent":        {map[string]any{"payload": map[string]any{}}, false},
+		"parent absent": {map[string]any{}, false},
+		"parent scalar": {map[string]any{"payload": "text"}, false},
+	} {
+		issues := check.Run(tc.packet, time.Now())
+		if tc.ok != (len(issues) == 0) {
+			t.Errorf("%s: issues = %+v", name, issues)
+		}
+		if !tc.ok && (issues[0].Code != "FIELD_MISSING" || issues[0].Path != "/payload/owner") {
+			t.Errorf("%s: issue = %+v, want FIELD_MISSING at /payload/owner", name, issues[0])
+		}
+	}
+}
@@ -1,25 +1,100 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
 	"crypto/ed25519"
+	"crypto/fips140"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
+	"github.com/Masterminds/semver/v3"
+	"github.com/dfeen87/Context-Broker/src/contextbroker"
 	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 var ttlRe = regexp.MustCompile(`^\s*(\d+)\s*([smhd])\s*$`)
 
+// fracSecondsRe captures the fractional seconds of an RFC3339 timestamp.
+var fracSecondsRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}[Tt ]\d{2}:\d{2}:\d{2}\.(\d+)([Zz]|[+-]\d{2}:\d{2})$`)
+
+var tzSuffixRe = regexp.MustCompile(`([Zz]|[+-]\d{2}:\d{2})$`)
+
+// envRefRe matches the ${NAME} references expandEnv substitutes, and their
+// $${NAME} escapes.
+var envRefRe = regexp.MustCompile(`\$\$?\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 const maxTTL = 365 * 24 * time.Hour
 
+const maxPacketBytes = 1 << 20 // 1 MB, matching the Python validator
+
+// maxCountExit keeps --count-exit codes below 126; shells reserve 126 and 127
+// for "not executable" and "not found", and 128+n for death by signal n.
+const maxCountExit = 125
+
+// exitCapped is the exit code of a batch run that stopped at --max-packets
+// without finding an invalid packet.
+const exitCapped = 4
+
+var countExit bool
+
+// issueTemplate renders each issue in place of the JSON report; nil unless
+// --template is set.
+var issueTemplate *template.Template
+
+// verbose receives -v diagnostics; it discards them unless -v is set.
+var verbose = log.New(io.Discard, "context-broker: ", 0)
+
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 func parseDuration(s string, label string) (time.Duration, error) {
 	trimmed := strings.TrimSpace(strings.ToLower(s))
 	m := ttlRe.FindStringSubmatch(trimmed)
@@ -49,203 +124,4909 @@ func parseDuration(s string, label string) (time.Duration, error) {
 	}
 }
 
-func main() {
-	packetPath := flag.String("packet", "", "Path to packet JSON")
-	schemasDir := flag.String("schemas-dir", "schemas", "Path to directory containing JSON Schema files")
-	clockSkewStr := flag.String("clock-skew", "60s", "Allowed clock skew tolerance (e.g., 60s, 5m)")
-	allowFutureStr := flag.String("allow-future-created-at", "5m", "Allowed future offset for created_at")
-	flag.Parse()
+// Issue is contextbroker.Issue: issues without a Severity are errors, and
+// warnings never make a packet invalid.
+type Issue = contextbroker.Issue
 
-	if *packetPath == "" {
-		fmt.Fprintln(os.Stderr, "missing --packet")
-		os.Exit(2)
+const (
+	severityWarning = contextbroker.SeverityWarning
+	severityInfo    = contextbroker.SeverityInfo
+)
+
+// messageCatalogs hold localized issue messages by language and then by code.
+// English is the source language, so its catalog is empty. An entry replaces
+// the message for its code; "{message}" in an entry expands to the English
+// message, which keeps details such as field names and limits. Codes without
+// an entry keep the English message.
+var messageCatalogs = map[string]map[string]string{
+	"en": {},
+}
+
+func localize(issues []Issue, catalog map[string]string) {
+	for i := range issues {
+		if tpl, ok := catalog[issues[i].Code]; ok {
+			issues[i].Message = strings.ReplaceAll(tpl, "{message}", issues[i].Message)
+		}
 	}
+}
 
-	clockSkew, err := parseDuration(*clockSkewStr, "clock-skew")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(2)
+func hasCode(issues []Issue, code string) bool {
+	for _, is := range issues {
+		if is.Code == code {
+			return true
+		}
 	}
+	return false
+}
 
-	allowFuture, err := parseDuration(*allowFutureStr, "allow-future-created-at")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(2)
+func hasErrors(issues []Issue) bool {
+	for _, is := range issues {
+		if is.Severity == "" {
+			return true
+		}
 	}
+	return false
+}
 
-	packetBytes, err := os.ReadFile(*packetPath)
-	if err != nil {
-		failTooling("PACKET_READ_ERROR", err)
+type Result struct {
+	Packet        string  `json:"packet,omitempty"`
+	OK            bool    `json:"ok"`
+	SchemaVersion string  `json:"schema_version,omitempty"`
+	Schema        string  `json:"schema,omitempty"`
+	SchemaID      string  `json:"schema_id,omitempty"`
+	Issues        []Issue `json:"issues"`
+	Canonical     string  `json:"canonical,omitempty"`
+	Checksum      string  `json:"checksum,omitempty"`
+
+	tooling bool
+	packet  map[string]any // as validated, after transforms and defaults
+}
+
+func toolingFailure(code string, err any) Result {
+	res := Result{OK: true, Issues: []Issue{}}
+	res.failTooling(code, err)
+	return res
+}
+
+func (r *Result) fail(code string, err any) {
+	r.OK = false
+	if se, ok := err.(*schemaError); ok {
+		r.Schema = se.file
+		r.Issues = append(r.Issues, se.issues(code)...)
+		return
 	}
+	r.Issues = append(r.Issues, Issue{Code: code, Message: fmt.Sprint(err)})
+}
 
-	var packet map[string]any
-	if err := json.Unmarshal(packetBytes, &packet); err != nil {
-		failTooling("PACKET_PARSE_ERROR", err)
+func (r *Result) failTooling(code string, err any) {
+	r.fail(code, err)
+	r.tooling = true
+}
+
+func (r *Result) exitCode() int {
+	if r.tooling {
+		return 2
 	}
+	if !r.OK {
+		return exitCodeFor(1)
+	}
+	return 0
+}
 
-	sv, ok := packet["schema_version"].(string)
-	if !ok || strings.TrimSpace(sv) == "" {
-		failValidation("UNSUPPORTED_SCHEMA_VERSION", "Missing or invalid schema_version")
+type batchReport struct {
+	OK      bool     `json:"ok"`
+	Total   int      `json:"total"`
+	Failed  int      `json:"failed"`
+	Skipped int      `json:"skipped,omitempty"`
+	Capped  int      `json:"capped,omitempty"` // known only for --tar and --dir
+	CapHit  bool     `json:"cap_reached,omitempty"`
+	Issues  []Issue  `json:"issues,omitempty"`
+	Results []Result `json:"results"`
+
+	tooling bool
+	// With a stream, results are written out as they are added instead of
+	// kept in Results; keepLinks keeps just their ids there for checkLinks.
+	stream        *resultStream
+	keepLinks     bool
+	codes         map[string]int
+	failedPackets []string
+}
+
+func (b *batchReport) add(r Result) {
+	b.Total++
+	if !r.OK {
+		b.OK = false
+		b.Failed++
+		b.failedPackets = append(b.failedPackets, r.Packet)
+	}
+	if b.codes == nil {
+		b.codes = map[string]int{}
+	}
+	for _, is := range r.Issues {
+		b.codes[is.Code]++
+	}
+	switch {
+	case b.stream == nil:
+		b.Results = append(b.Results, r)
+	case b.keepLinks:
+		ids := map[string]any{"context_id": r.packet["context_id"], "parent_id": r.packet["parent_id"]}
+		b.Results = append(b.Results, Result{Packet: r.Packet, packet: ids})
+		fallthrough
+	default:
+		b.stream.write(r)
 	}
+}
 
-	schemaPath := fmt.Sprintf("%s/context_packet.schema.v%s.json", *schemasDir, sv)
-	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
-		failValidation("UNSUPPORTED_SCHEMA_VERSION", fmt.Sprintf("Unsupported schema version: %s", sv))
+// batchTotals is a batch report without its results: what a resultStream
+// writes after them.
+type batchTotals struct {
+	OK      bool    `json:"ok"`
+	Total   int     `json:"total"`
+	Failed  int     `json:"failed"`
+	Skipped int     `json:"skipped,omitempty"`
+	Capped  int     `json:"capped,omitempty"`
+	CapHit  bool    `json:"cap_reached,omitempty"`
+	Issues  []Issue `json:"issues,omitempty"`
+}
+
+// resultStream writes the results of a --packets-stdin report as each packet
+// is validated, so neither the output nor memory waits on the whole array.
+// The JSON form is the usual report with "results" moved first; with
+// --template it is the usual lines.
+type resultStream struct {
+	w io.Writer
+	n int
+}
+
+func newResultStream(w io.Writer) *resultStream {
+	if issueTemplate == nil {
+		io.WriteString(w, "{\n  \"results\": [")
 	}
+	return &resultStream{w: w}
+}
 
-	schemaCompiler := jsonschema.NewCompiler()
-	schemaFile, err := os.Open(schemaPath)
+func (s *resultStream) write(r Result) {
+	if issueTemplate != nil {
+		if err := writeIssues(s.w, issueTemplate, r); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	sep := ",\n    "
+	if s.n == 0 {
+		sep = "\n    "
+	}
+	out, err := encodeIndented(r, "    ")
 	if err != nil {
-		failTooling("SCHEMA_LOAD_ERROR", err)
+		fmt.Fprintln(os.Stderr, "failed to serialize result:", err)
+		os.Exit(2)
 	}
-	defer schemaFile.Close()
+	s.n++
+	io.WriteString(s.w, sep)
+	s.w.Write(bytes.TrimSuffix(out, []byte("\n")))
+}
 
-	if err := schemaCompiler.AddResource("schema.json", schemaFile); err != nil {
-		failTooling("SCHEMA_LOAD_ERROR", err)
+func (s *resultStream) close(b *batchReport) {
+	if issueTemplate != nil {
+		if err := writeIssues(s.w, issueTemplate, batchReport{OK: b.OK, Issues: b.Issues}); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
 	}
-
-	schema, err := schemaCompiler.Compile("schema.json")
+	if s.n > 0 {
+		io.WriteString(s.w, "\n  ")
+	}
+	// The totals encode as an object of their own; drop its opening brace
+	// to continue the one opened by newResultStream.
+	tail, err := encodeIndented(batchTotals{OK: b.OK, Total: b.Total, Failed: b.Failed, Skipped: b.Skipped, Capped: b.Capped, CapHit: b.CapHit, Issues: b.Issues}, "")
 	if err != nil {
-		failTooling("SCHEMA_COMPILE_ERROR", err)
+		fmt.Fprintln(os.Stderr, "failed to serialize report:", err)
+		os.Exit(2)
 	}
+	io.WriteString(s.w, "],\n")
+	s.w.Write(bytes.TrimPrefix(tail, []byte("{\n")))
+}
 
-	if err := schema.Validate(packet); err != nil {
-		failValidation("SCHEMA_VIOLATION", err)
+// batchSummary is the --summary roll-up of a batch report.
+type batchSummary struct {
+	OK            bool           `json:"ok"`
+	Total         int            `json:"total"`
+	Failed        int            `json:"failed"`
+	Skipped       int            `json:"skipped"`
+	Capped        int            `json:"capped,omitempty"`
+	CapHit        bool           `json:"cap_reached,omitempty"`
+	Codes         map[string]int `json:"codes"`
+	FailedPackets []string       `json:"failed_packets"`
+}
+
+func (b *batchReport) summary() batchSummary {
+	sum := batchSummary{OK: b.OK, Total: b.Total, Failed: b.Failed, Skipped: b.Skipped, Capped: b.Capped, CapHit: b.CapHit, Codes: map[string]int{}, FailedPackets: append([]string{}, b.failedPackets...)}
+	for code, n := range b.codes {
+		sum.Codes[code] = n
 	}
+	for _, is := range b.Issues {
+		sum.Codes[is.Code]++
+	}
+	return sum
+}
 
-	if err := verifyIntegrity(packet); err != nil {
-		failValidation("INTEGRITY_FAILURE", err)
+// expiryGate is the --gate-expiry report: the expired packets, and those whose
+// expiry could not be read, in place of full results.
+type expiryGate struct {
+	OK               bool     `json:"ok"`
+	Total            int      `json:"total"`
+	Expired          int      `json:"expired"`
+	Skipped          int      `json:"skipped,omitempty"`
+	Capped           int      `json:"capped,omitempty"`
+	CapHit           bool     `json:"cap_reached,omitempty"`
+	ExpiredPackets   []string `json:"expired_packets"`
+	UncheckedPackets []string `json:"unchecked_packets,omitempty"`
+	Issues           []Issue  `json:"issues,omitempty"`
+}
+
+func (b *batchReport) expiryGate() expiryGate {
+	gate := expiryGate{OK: b.OK, Total: b.Total, Skipped: b.Skipped, Capped: b.Capped, CapHit: b.CapHit, ExpiredPackets: []string{}, Issues: b.Issues}
+	for _, r := range b.Results {
+		switch {
+		case r.OK:
+		case hasCode(r.Issues, "TIME_EXPIRED"):
+			gate.Expired++
+			gate.ExpiredPackets = append(gate.ExpiredPackets, r.Packet)
+		default:
+			gate.UncheckedPackets = append(gate.UncheckedPackets, r.Packet)
+		}
 	}
+	return gate
+}
 
-	createdAtStr, ok := packet["created_at"].(string)
-	if !ok {
-		failValidation("TIME_INVALID_CREATED_AT", "created_at must be a string")
+func (b *batchReport) exitCode() int {
+	if b.tooling {
+		return 2
 	}
-	createdAt, err := time.Parse(time.RFC3339Nano, createdAtStr)
-	if err != nil {
-		failValidation("TIME_INVALID_CREATED_AT", err)
+	if b.Failed == 0 && !b.OK {
+		// Only batch-wide checks such as --check-links fail a report
+		// without failing a packet.
+		return exitCodeFor(1)
 	}
+	if b.Failed == 0 && b.CapHit {
+		return exitCapped
+	}
+	return exitCodeFor(b.Failed)
+}
 
-	expiresAtStr, ok := packet["expires_at"].(string)
-	if !ok {
-		failValidation("TIME_INVALID_EXPIRES_AT", "expires_at must be a string")
+type fieldRename struct {
+	from, to string
+}
+
+// ttlRange bounds the ttl of one --class-rules class; a zero bound is open.
+type ttlRange struct {
+	min, max time.Duration
+}
+
+type semverRule struct {
+	field      string
+	constraint *semver.Constraints // nil when the field only has to parse
+	raw        string
+}
+
+type arrayLimit struct {
+	field string
+	max   int
+}
+
+type namedSchema struct {
+	name   string
+	schema *jsonschema.Schema
+}
+
+type validator struct {
+	candidates     []namedSchema // override the schemasDir lookup when set
+	parallel       bool          // try candidates concurrently
+	reportSchema   bool          // name the matched schema even with one candidate
+	setupIssues    []Issue       // warnings from loading candidates, repeated in every result
+	schemasDir     string
+	clockSkew      time.Duration
+	expirySkew     time.Duration // clockSkew unless --expiry-skew
+	allowFuture    time.Duration
+	dateOrders     [][]string
+	noTime         bool
+	rejectSubnano  bool
+	expireBefore   time.Time // zero when there is no deadline
+	consistentTZ   bool
+	epochInterval  time.Duration // 0 unless --epoch-check
+	classRules     map[string]ttlRange
+	minTTLUnit     string // "" when any ttl unit is accepted
+	arrayLimits    []arrayLimit
+	maxDepth       int
+	maxDepthField  string
+	metadataField  string                // "" when metadata keys are not checked
+	metadataKeyRe  *regexp.Regexp        // with metadataField
+	checks         []contextbroker.Check // registered and --check checks, run after the built-in ones
+	durationFields []string
+	enumCaseFields []string // enum fields matched ignoring case
+	semverRules    []semverRule
+	deterministic  bool
+	maxIssues      int
+	failFast       bool
+	catalog        map[string]string
+
+	midnightThreshold int
+	warnUnusedFields  bool
+
+	coerceTTLSeconds bool
+	deriveTTL        *ttlDerivation // nil unless --derive-ttl
+	renames          []fieldRename
+	applyDefaults    bool
+	canonicalize     bool
+	trimStrings      bool // with canonicalize
+	warnWhitespace   bool
+	requireCanonical bool
+	emitChecksum     bool
+
+	sigFieldsAllOrNone bool
+	fips               bool
+	checkContentLength bool
+	checkContentType   bool
+	trustedProducers   map[string]bool // nil when any producer is accepted
+
+	replayField string
+	replay      NonceStore // nil unless --replay-protect
+
+	policy *policyClient // nil unless --policy-url
+
+	expectSchemaID string
+
+	mu      sync.Mutex
+	schemas map[string]*jsonschema.Schema
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "schema-lint":
+			os.Exit(runSchemaLint(os.Args[2:]))
+		case "schema-diff":
+			os.Exit(runSchemaDiff(os.Args[2:]))
+		case "explain-field":
+			os.Exit(runExplainField(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "health":
+			os.Exit(runHealth(os.Args[2:]))
+		case "exit-codes":
+			os.Exit(runExitCodes(os.Args[2:]))
+		}
 	}
-	expiresAt, err := time.Parse(time.RFC3339Nano, expiresAtStr)
-	if err != nil {
-		failValidation("TIME_INVALID_EXPIRES_AT", err)
+
+	packetPath := flag.String("packet", "", "Path or http(s):// URL of packet JSON")
+	var headerExprs stringList
+	flag.Var(&headerExprs, "header", "HTTP header sent when --packet is a URL, as 'Name: value' (repeatable)")
+	templateStr := flag.String("template", "", "Print each issue through this Go text/template, e.g. '{{.Packet}} {{.Code}} {{.Message}}', instead of the JSON report")
+	getPointer := flag.String("get", "", "With --packet, print the value at this JSON pointer instead of the result when the packet is valid")
+	fetchTimeoutStr := flag.String("fetch-timeout", "30s", "Timeout for fetching a --packet URL or asking --policy-url")
+	fetchRetries := flag.Int("fetch-retries", 0, "Retry a --packet URL or --policy-url request this many times after a network error, 429, or 5xx")
+	policyURL := flag.String("policy-url", "", "After built-in checks pass, POST {\"input\": packet} to this OPA-style decision service and fail with POLICY_DENIED on deny")
+	tarPath := flag.String("tar", "", "Path to a .tar or .tar.gz archive of packet JSON files")
+	dirPath := flag.String("dir", "", "Validate every *.json file under this directory")
+	objectMapPath := flag.String("object-map", "", "Validate each value of a JSON object of packets in this file, keyed by its map key")
+	mapKeyField := flag.String("map-key-field", "", "With --object-map, require this field (dotted path) of each packet to equal its map key")
+	packetsStdin := flag.Bool("packets-stdin", false, "Validate each element of a JSON array of packets read from stdin")
+	sinceStr := flag.String("since", "", "With --tar or --dir, skip packets last modified before this RFC3339 instant")
+	gateExpiry := flag.Bool("gate-expiry", false, "In a batch mode, check only expiry and report just the expired packets and their count")
+	linkCheck := flag.Bool("check-links", false, "In a batch mode, require every parent_id to name a context_id in the batch, without cycles")
+	summaryPath := flag.String("summary", "", "In a batch mode (--tar, --dir, --packets-stdin, --object-map), also write totals, per-code counts, and failed packets to this file")
+	auditLogPath := flag.String("audit-log", "", "Append one JSON line per validation outcome to this file")
+	outputDir := flag.String("output-dir", "", "Also write each packet's result to DIR/<name>.result.json")
+	serveAddr := flag.String("serve", "", "Serve POST /validate over HTTP on this address (e.g. :8080)")
+	grpcAddr := flag.String("grpc", "", "With --serve, also serve the contextbroker.v1.Validator gRPC service, with reflection, on this address")
+	maxInflight := flag.Int("max-inflight", 0, "With --serve, cap concurrent validations; excess requests get 429 (0 = unlimited)")
+	queueTimeoutStr := flag.String("queue-timeout", "", "With --max-inflight, wait this long for a free slot before answering 429")
+	kindSchemas := flag.String("schemas", "", "With --serve, schemas selected by the X-Packet-Kind request header, as kind=path,...")
+	maxBodySize := flag.Int64("max-body-size", maxPacketBytes, "With --serve, largest accepted request body in bytes")
+	var schemaPaths stringList
+	flag.Var(&schemaPaths, "schema", "Path to a specific JSON Schema file. Overrides --schemas-dir; repeat to try several candidates")
+	parallelSchemas := flag.Bool("parallel-schemas", false, "With several --schema candidates, try them concurrently for each packet")
+	reportSchemaPath := flag.Bool("report-schema-path", false, "Record the schema file and $id that validated each packet in its result")
+	schemaBestEffort := flag.Bool("schema-best-effort", false, "Skip --schema files that fail to compile, with a warning, instead of aborting")
+	schemaInline := flag.String("schema-inline", "", "JSON Schema document given as a string. Overrides --schemas-dir")
+	schemaBundle := flag.String("schema-bundle", "", "Path to a JSON file of named schemas, {\"schemas\": {name: schema}}. Overrides --schemas-dir")
+	expectSchemaID := flag.String("expect-schema-id", "", "Fail with SCHEMA_ID_MISMATCH unless each loaded schema's root $id equals this URL")
+	schemaRoot := flag.String("schema-root", "", "With --schema-bundle, the name of the schema packets are validated against")
+	schemasDir := flag.String("schemas-dir", "schemas", "Path to directory containing JSON Schema files")
+	clockSkewStr := flag.String("clock-skew", "60s", "Allowed clock skew tolerance (e.g., 60s, 5m)")
+	skewStr := flag.String("skew", "", "Shortcut setting both --expiry-skew and --future-skew, where not given themselves")
+	expirySkewStr := flag.String("expiry-skew", "", "How long past expires_at a packet is still accepted (default: --skew, else --clock-skew)")
+	futureSkewStr := flag.String("future-skew", "", "How far in the future created_at may be (default: --skew, else --allow-future-created-at)")
+	allowFutureStr := flag.String("allow-future-created-at", "5m", "Allowed future offset for created_at; --future-skew is the same setting")
+	var dateOrderExprs stringList
+	flag.BoolVar(&countExit, "count-exit", false, "Exit with the number of failed packets (capped at 125) instead of 1")
+	flag.Var(&dateOrderExprs, "date-order", "Require RFC3339 fields to be ordered, e.g. payload.effective_from<=payload.effective_until<=expires_at (repeatable)")
+	var durationFields stringList
+	flag.Var(&durationFields, "duration-field", "Require this field, if present, to be an <int><s|m|h|d> duration like ttl (dotted path, repeatable)")
+	var checkSpecs stringList
+	flag.Var(&checkSpecs, "check", "Run a curated check, as NAME=ARG: context-id-prefix=PREFIX or require-field=FIELD (repeatable)")
+	var enumCaseFields stringList
+	flag.Var(&enumCaseFields, "enum-case-insensitive", "Accept a value of this schema enum field (dotted path, repeatable) that matches only when ignoring case, with a warning")
+	var semverFields, semverConstraints stringList
+	flag.Var(&semverFields, "semver", "Require this field, if present, to be a semantic version (dotted path, repeatable)")
+	flag.Var(&semverConstraints, "semver-constraint", "Require a semantic version field to satisfy a range, as field=constraint, e.g. producer_version=>=1.2.0 (repeatable)")
+	maxDepth := flag.Int("max-depth", 0, "Fail packets nested more than N objects or arrays deep (0 = unlimited)")
+	metadataField := flag.String("metadata-field", "", "Require every key of this object (dotted path, e.g. metadata) to match --metadata-key-pattern")
+	metadataKeyPattern := flag.String("metadata-key-pattern", `^[a-z][a-z0-9]*(_[a-z0-9]+)*$`, "The regular expression each --metadata-field key must match; given alone, it checks metadata")
+	maxDepthField := flag.String("max-depth-field", "", "With --max-depth, measure only this field (dotted path) instead of the whole packet")
+	var maxArrayExprs stringList
+	flag.Var(&maxArrayExprs, "max-array", "Fail when an array field has more than N elements, as field=N with a dotted path (repeatable)")
+	classRulesPath := flag.String("class-rules", "", "JSON file mapping each packet class to its allowed ttl range, e.g. {\"session\": {\"min_ttl\": \"5m\", \"max_ttl\": \"1d\"}}")
+	expireBeforeStr := flag.String("expire-before", "", "Fail packets whose expires_at is after this RFC3339 deadline")
+	minTTLUnit := flag.String("min-ttl-granularity", "", "Fail a ttl written in a unit finer than this one (s, m, h, or d)")
+	rejectSubnano := flag.Bool("reject-subnano", false, "Fail timestamps with more than 9 fractional second digits instead of truncating them")
+	noTime := flag.Bool("no-time", false, "Skip the created_at, ttl, and expires_at rules; schema and opt-in checks still run")
+	consistentTZ := flag.Bool("consistent-tz", false, "Require created_at and expires_at to write their UTC offset the same way")
+	epochCheckExpr := flag.String("epoch-check", "", "Require created_at to equal epoch_start + generation * interval, as interval=DURATION")
+	deterministic := flag.Bool("deterministic", false, "Sort issues by code, then path, for reproducible output")
+	warnMidnight := flag.Bool("warn-midnight-utc", false, "Warn when many timestamps fall exactly on UTC midnight (heuristic, non-fatal)")
+	warnUnusedFields := flag.Bool("warn-unused-schema-fields", false, "Note optional schema properties the packet leaves out (info, never fails a packet)")
+	midnightThreshold := flag.Int("midnight-threshold", 2, "Number of UTC-midnight timestamps that triggers --warn-midnight-utc")
+	ntpServer := flag.String("ntp", "", "Query this NTP server (host[:port]) and correct the local clock by its offset")
+	ntpMaxOffsetStr := flag.String("ntp-max-offset", "5s", "Largest local clock offset from --ntp that is still trusted")
+	ntpTimeoutStr := flag.String("ntp-timeout", "5s", "Timeout for the --ntp query")
+	coerceTTLSeconds := flag.Bool("coerce-ttl-seconds", false, "Convert a numeric ttl in seconds to the <int><unit> string form before validation")
+	deriveTTLExpr := flag.String("derive-ttl", "", "Check ttl against the window between two timestamp fields, as from=FIELD,until=FIELD; with --canonicalize, fill an absent ttl from it")
+	var renameExprs stringList
+	flag.Var(&renameExprs, "rename", "Rename a top-level field before validation, as old=new (repeatable)")
+	applyDefaults := flag.Bool("apply-defaults", false, "Fill absent fields with their schema defaults before the time checks")
+	emitChecksum := flag.Bool("emit-checksum", false, "Include the SHA-256 of the canonical packet in each successful result")
+	requireCanonical := flag.Bool("require-canonical", false, "Fail packets whose source is not already in canonical form, ignoring whitespace")
+	canonicalize := flag.Bool("canonicalize", false, "Include the canonical form of the validated packet in each result")
+	trimStrings := flag.Bool("trim-strings", false, "With --canonicalize, strip surrounding whitespace from every string value")
+	warnWhitespace := flag.Bool("warn-string-whitespace", false, "Warn with STRING_WHITESPACE for every string value with surrounding whitespace")
+	replayProtect := flag.Bool("replay-protect", false, "Reject a valid packet whose --replay-field value was already accepted and has not expired")
+	replayField := flag.String("replay-field", "context_id", "With --replay-protect, the dotted path of the field that identifies a packet")
+	replayCacheSize := flag.Int("replay-cache-size", 100000, "With --replay-protect, the most identifiers remembered at once")
+	lang := flag.String("lang", "en", "Language of issue messages; codes are never translated")
+	verboseFlag := flag.Bool("v", false, "Log transforms and other diagnostics to stderr")
+	failFast := flag.Bool("fail-fast", false, "Stop checking a packet at its first error")
+	maxPackets := flag.Int("max-packets", 0, "In a batch mode, stop after validating this many packets (exit 4 if none failed)")
+	failFastBatch := flag.Bool("fail-fast-batch", false, "In a batch mode, also stop the run at the first failing packet (implies --fail-fast)")
+	maxIssues := flag.Int("max-issues", 0, "Report at most N issues per packet, followed by a TRUNCATED marker (0 = unlimited)")
+	trustedProducers := flag.String("trusted-producers", "", "Accept only packets whose producer_id is in this comma-separated list")
+	trustedProducersFile := flag.String("trusted-producers-file", "", "Accept only packets whose producer_id is listed in this file, one per line")
+	checkContentType := flag.Bool("check-content-type", false, "Require payload's JSON kind to match content_type, e.g. an object or array for application/json")
+	checkContentLength := flag.Bool("check-content-length", false, "Require content_length to equal the byte length of the canonical payload")
+	fips := flag.Bool("fips", false, "Require the Go FIPS 140-3 module and reject packets declaring non-approved alg or hash_alg values")
+	sigFieldsAllOrNone := flag.Bool("sig-fields-all-or-none", false, "Require signature, signer_key_id, and signed_at to be present together or not at all")
+	flag.Parse()
+
+	if *verboseFlag {
+		verbose.SetOutput(os.Stderr)
 	}
 
-	ttlStr, ok := packet["ttl"].(string)
-	if !ok {
-		failValidation("TIME_INVALID_TTL", "ttl must be a string")
+	var err error
+	if *packetPath, err = expandEnv(*packetPath); err != nil {
+		fmt.Fprintf(os.Stderr, "packet: %v\n", err)
+		os.Exit(2)
 	}
-	ttl, err := parseDuration(ttlStr, "ttl")
-	if err != nil {
-		failValidation("TIME_INVALID_TTL", err)
+	for i := range schemaPaths {
+		if schemaPaths[i], err = expandEnv(schemaPaths[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "schema: %v\n", err)
+			os.Exit(2)
+		}
 	}
-	if ttl > maxTTL {
-		failValidation("TTL_TOO_LONG", fmt.Sprintf("ttl exceeds maximum allowed duration (%v)", maxTTL))
+
+	modes := 0
+	for _, mode := range []string{*packetPath, *tarPath, *dirPath, *objectMapPath, *serveAddr} {
+		if mode != "" {
+			modes++
+		}
+	}
+	if *packetsStdin {
+		modes++
+	}
+	if modes == 0 {
+		fmt.Fprintln(os.Stderr, "missing --packet, --tar, --dir, --packets-stdin, --object-map, or --serve")
+		os.Exit(2)
+	}
+	if modes > 1 {
+		fmt.Fprintln(os.Stderr, "--packet, --tar, --dir, --packets-stdin, --object-map, and --serve are mutually exclusive")
+		os.Exit(2)
+	}
+	batch := *tarPath != "" || *dirPath != "" || *packetsStdin || *objectMapPath != ""
+	if *parallelSchemas && len(schemaPaths) == 0 {
+		fmt.Fprintln(os.Stderr, "--parallel-schemas requires --schema")
+		os.Exit(2)
+	}
+	if *mapKeyField != "" && *objectMapPath == "" {
+		fmt.Fprintln(os.Stderr, "--map-key-field requires --object-map")
+		os.Exit(2)
+	}
+	var since time.Time
+	if *sinceStr != "" {
+		if *tarPath == "" && *dirPath == "" {
+			fmt.Fprintln(os.Stderr, "--since requires --tar or --dir")
+			os.Exit(2)
+		}
+		t, err := time.Parse(time.RFC3339Nano, *sinceStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "since must be an RFC3339 timestamp: %v\n", err)
+			os.Exit(2)
+		}
+		since = t
+	}
+	var expireBefore time.Time
+	if *expireBeforeStr != "" {
+		t, err := time.Parse(time.RFC3339Nano, *expireBeforeStr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "expire-before must be an RFC3339 timestamp: %v\n", err)
+			os.Exit(2)
+		}
+		expireBefore = t
+	}
+	if *trimStrings && !*canonicalize {
+		fmt.Fprintln(os.Stderr, "--trim-strings requires --canonicalize")
+		os.Exit(2)
+	}
+	var epochInterval time.Duration
+	if *epochCheckExpr != "" {
+		if epochInterval, err = parseEpochCheck(*epochCheckExpr); err != nil {
+			fmt.Fprintf(os.Stderr, "epoch-check: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	var deriveTTL *ttlDerivation
+	if *deriveTTLExpr != "" {
+		if deriveTTL, err = parseTTLDerivation(*deriveTTLExpr); err != nil {
+			fmt.Fprintf(os.Stderr, "derive-ttl: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *grpcAddr != "" && *serveAddr == "" {
+		fmt.Fprintln(os.Stderr, "--grpc requires --serve")
+		os.Exit(2)
+	}
+	if *outputDir != "" && *serveAddr != "" {
+		fmt.Fprintln(os.Stderr, "--output-dir does not apply to --serve")
+		os.Exit(2)
+	}
+	if *gateExpiry && !batch {
+		fmt.Fprintln(os.Stderr, "--gate-expiry requires --tar, --dir, --packets-stdin, or --object-map")
+		os.Exit(2)
+	}
+	if *maxPackets < 0 {
+		fmt.Fprintln(os.Stderr, "--max-packets must not be negative")
+		os.Exit(2)
+	}
+	if *maxPackets > 0 && !batch {
+		fmt.Fprintln(os.Stderr, "--max-packets requires --tar, --dir, --packets-stdin, or --object-map")
+		os.Exit(2)
+	}
+	if *gateExpiry && *noTime {
+		fmt.Fprintln(os.Stderr, "--gate-expiry cannot be combined with --no-time")
+		os.Exit(2)
+	}
+	if *templateStr != "" {
+		if *serveAddr != "" || *gateExpiry {
+			fmt.Fprintln(os.Stderr, "--template cannot be combined with --serve or --gate-expiry")
+			os.Exit(2)
+		}
+		if issueTemplate, err = parseIssueTemplate(*templateStr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *linkCheck && !batch {
+		fmt.Fprintln(os.Stderr, "--check-links requires --tar, --dir, --packets-stdin, or --object-map")
+		os.Exit(2)
+	}
+	if *summaryPath != "" && !batch {
+		fmt.Fprintln(os.Stderr, "--summary requires --tar, --dir, --packets-stdin, or --object-map")
+		os.Exit(2)
+	}
+	if *getPointer != "" && *packetPath == "" {
+		fmt.Fprintln(os.Stderr, "--get requires --packet")
+		os.Exit(2)
+	}
+	if *getPointer != "" && !strings.HasPrefix(*getPointer, "/") {
+		fmt.Fprintf(os.Stderr, "get %q must be a JSON pointer starting with /\n", *getPointer)
+		os.Exit(2)
+	}
+	if *maxInflight < 0 || *maxBodySize <= 0 {
+		fmt.Fprintln(os.Stderr, "max-inflight must not be negative and max-body-size must be positive")
+		os.Exit(2)
+	}
+	var queueTimeout time.Duration
+	if *queueTimeoutStr != "" {
+		d, err := parseDuration(*queueTimeoutStr, "queue-timeout")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		queueTimeout = d
 	}
 
-	expected := createdAt.Add(ttl)
-	diff := expiresAt.Sub(expected)
-	if diff < 0 {
-		diff = -diff
+	schemaSources := 0
+	for _, set := range []bool{len(schemaPaths) > 0, *schemaInline != "", *schemaBundle != ""} {
+		if set {
+			schemaSources++
+		}
 	}
-	tolerance := clockSkew
-	if tolerance < time.Second {
-		tolerance = time.Second
+	if schemaSources > 1 {
+		fmt.Fprintln(os.Stderr, "--schema, --schema-inline, and --schema-bundle are mutually exclusive")
+		os.Exit(2)
 	}
-	if diff > tolerance {
-		failValidation("TIME_MISMATCH", "expires_at != created_at + ttl")
+	if (*schemaBundle == "") != (*schemaRoot == "") {
+		fmt.Fprintln(os.Stderr, "--schema-bundle and --schema-root must be given together")
+		os.Exit(2)
+	}
+
+	clockSkew, err := parseDuration(*clockSkewStr, "clock-skew")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	now := time.Now().UTC()
-	if createdAt.Sub(now) > allowFuture {
-		failValidation("TIME_CREATED_AT_IN_FUTURE", "created_at is too far in the future")
+	legacyFuture := false
+	flag.Visit(func(f *flag.Flag) { legacyFuture = legacyFuture || f.Name == "allow-future-created-at" })
+	expirySkew, allowFuture, err := resolveSkews(clockSkew, *skewStr, *expirySkewStr, *futureSkewStr, *allowFutureStr, legacyFuture)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	if now.Sub(expiresAt) > clockSkew {
-		failValidation("TIME_EXPIRED", "context packet expired")
+	catalog, ok := messageCatalogs[*lang]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "lang %q is not available (have %s)\n", *lang, strings.Join(sortedKeys(messageCatalogs), ", "))
+		os.Exit(2)
 	}
 
-	successOut := map[string]any{
-		"ok":             true,
-		"schema_version": sv,
-		"issues":         []map[string]string{},
+	if *maxDepth < 0 {
+		fmt.Fprintln(os.Stderr, "max-depth must not be negative")
+		os.Exit(2)
 	}
-	b, marshalErr := json.MarshalIndent(successOut, "", "  ")
-	if marshalErr != nil {
-		fmt.Println(`{"ok":true}`)
-	} else {
-		fmt.Println(string(b))
+	if *maxDepthField != "" && *maxDepth == 0 {
+		fmt.Fprintln(os.Stderr, "--max-depth-field requires --max-depth")
+		os.Exit(2)
+	}
+	checks := contextbroker.Registered()
+	for _, spec := range checkSpecs {
+		c, err := contextbroker.ParseCheck(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check: %v\n", err)
+			os.Exit(2)
+		}
+		checks = append(checks, c)
+	}
+	patternSet := false
+	flag.Visit(func(f *flag.Flag) { patternSet = patternSet || f.Name == "metadata-key-pattern" })
+	metadataKeyField, metadataKeyRe, err := parseMetadataCheck(*metadataField, *metadataKeyPattern, patternSet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "metadata-key-pattern %q: %v\n", *metadataKeyPattern, err)
+		os.Exit(2)
 	}
-	os.Exit(0)
-}
 
-func verifyIntegrity(packet map[string]any) error {
-	sigStr, hasSig := packet["signature"].(string)
-	pubStr, hasPub := packet["public_key_id"].(string)
+	if *maxIssues < 0 {
+		fmt.Fprintln(os.Stderr, "max-issues must not be negative")
+		os.Exit(2)
+	}
 
-	if !hasSig && !hasPub {
-		return nil
+	if *warnMidnight && *midnightThreshold < 1 {
+		fmt.Fprintln(os.Stderr, "midnight-threshold must be positive")
+		os.Exit(2)
 	}
-	if hasSig != hasPub {
-		return errors.New("both signature and public_key_id must be provided together or omitted")
+
+	ntpMaxOffset, err := parseDuration(*ntpMaxOffsetStr, "ntp-max-offset")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
 
-	sigBytes, err := base64.StdEncoding.DecodeString(sigStr)
+	ntpTimeout, err := parseDuration(*ntpTimeoutStr, "ntp-timeout")
 	if err != nil {
-		return fmt.Errorf("failed to decode signature: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	pubBytes, err := base64.StdEncoding.DecodeString(pubStr)
+
+	fetchTimeout, err := parseDuration(*fetchTimeoutStr, "fetch-timeout")
 	if err != nil {
-		return fmt.Errorf("failed to decode public_key_id: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	if len(pubBytes) != ed25519.PublicKeySize {
-		return errors.New("invalid ed25519 public key size")
+	if *fetchRetries < 0 {
+		fmt.Fprintln(os.Stderr, "fetch-retries must not be negative")
+		os.Exit(2)
+	}
+	if *policyURL != "" && !isURL(*policyURL) {
+		fmt.Fprintln(os.Stderr, "policy-url must be an http:// or https:// URL")
+		os.Exit(2)
 	}
 
-	canonicalPacket := make(map[string]any)
-	for k, v := range packet {
-		if k != "signature" && k != "public_key_id" {
-			canonicalPacket[k] = v
+	headers := http.Header{}
+	for _, expr := range headerExprs {
+		name, value, ok := strings.Cut(expr, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			fmt.Fprintf(os.Stderr, "header %q must be of the form 'Name: value'\n", expr)
+			os.Exit(2)
 		}
+		headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
 	}
 
-	canonicalBytes, err := json.Marshal(canonicalPacket)
-	if err != nil {
-		return fmt.Errorf("failed to canonicalize packet: %v", err)
+	var renames []fieldRename
+	for _, expr := range renameExprs {
+		from, to, ok := strings.Cut(expr, "=")
+		if !ok || from == "" || to == "" {
+			fmt.Fprintf(os.Stderr, "rename %q must be of the form old=new\n", expr)
+			os.Exit(2)
+		}
+		renames = append(renames, fieldRename{from: from, to: to})
 	}
 
-	if !ed25519.Verify(ed25519.PublicKey(pubBytes), canonicalBytes, sigBytes) {
-		return errors.New("signature verification failed")
+	var dateOrders [][]string
+	for _, expr := range dateOrderExprs {
+		fields, err := parseDateOrder(expr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		dateOrders = append(dateOrders, fields)
 	}
 
-	return nil
-}
+	var semverRules []semverRule
+	for _, field := range semverFields {
+		semverRules = append(semverRules, semverRule{field: field})
+	}
+	for _, expr := range semverConstraints {
+		field, raw, ok := strings.Cut(expr, "=")
+		if !ok || field == "" || raw == "" {
+			fmt.Fprintf(os.Stderr, "semver-constraint %q must be of the form field=constraint\n", expr)
+			os.Exit(2)
+		}
+		c, err := semver.NewConstraint(raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "semver-constraint %q: %v\n", expr, err)
+			os.Exit(2)
+		}
+		semverRules = append(semverRules, semverRule{field: field, constraint: c, raw: raw})
+	}
 
-func failValidation(code string, err any) {
-	emitFailure(code, err)
-	os.Exit(1)
-}
+	var arrayLimits []arrayLimit
+	for _, expr := range maxArrayExprs {
+		field, n, ok := strings.Cut(expr, "=")
+		max, err := strconv.Atoi(n)
+		if !ok || field == "" || err != nil || max < 0 {
+			fmt.Fprintf(os.Stderr, "max-array %q must be of the form field=N with N >= 0\n", expr)
+			os.Exit(2)
+		}
+		arrayLimits = append(arrayLimits, arrayLimit{field: field, max: max})
+	}
 
-func failTooling(code string, err any) {
-	emitFailure(code, err)
+	v := &validator{
+		schemasDir:     *schemasDir,
+		clockSkew:      clockSkew,
+		expirySkew:     expirySkew,
+		allowFuture:    allowFuture,
+		dateOrders:     dateOrders,
+		noTime:         *noTime,
+		rejectSubnano:  *rejectSubnano,
+		expireBefore:   expireBefore,
+		consistentTZ:   *consistentTZ,
+		epochInterval:  epochInterval,
+		arrayLimits:    arrayLimits,
+		maxDepth:       *maxDepth,
+		maxDepthField:  *maxDepthField,
+		metadataField:  metadataKeyField,
+		metadataKeyRe:  metadataKeyRe,
+		checks:         checks,
+		durationFields: durationFields,
+		enumCaseFields: enumCaseFields,
+		semverRules:    semverRules,
+		deterministic:  *deterministic,
+		maxIssues:      *maxIssues,
+		failFast:       *failFast || *failFastBatch,
+		catalog:        catalog,
+		schemas:        map[string]*jsonschema.Schema{},
+		expectSchemaID: *expectSchemaID,
+		parallel:       *parallelSchemas,
+		reportSchema:   *reportSchemaPath,
+
+		coerceTTLSeconds: *coerceTTLSeconds,
+		deriveTTL:        deriveTTL,
+		renames:          renames,
+		applyDefaults:    *applyDefaults,
+		canonicalize:     *canonicalize,
+		trimStrings:      *trimStrings,
+		warnWhitespace:   *warnWhitespace,
+		requireCanonical: *requireCanonical,
+		emitChecksum:     *emitChecksum,
+
+		sigFieldsAllOrNone: *sigFieldsAllOrNone,
+		fips:               *fips,
+		checkContentLength: *checkContentLength,
+		checkContentType:   *checkContentType,
+		warnUnusedFields:   *warnUnusedFields,
+	}
+	if *warnMidnight {
+		v.midnightThreshold = *midnightThreshold
+	}
+	if *replayProtect {
+		if *noTime {
+			fmt.Fprintln(os.Stderr, "--replay-protect relies on expiry checks and cannot be combined with --no-time")
+			os.Exit(2)
+		}
+		if *replayCacheSize < 1 {
+			fmt.Fprintln(os.Stderr, "replay-cache-size must be positive")
+			os.Exit(2)
+		}
+		v.replayField = *replayField
+		v.replay = newMemoryNonceStore(*replayCacheSize)
+	}
+	if *policyURL != "" {
+		v.policy = &policyClient{url: *policyURL, client: &http.Client{Timeout: fetchTimeout}, retries: *fetchRetries}
+	}
+	if *trustedProducers != "" || *trustedProducersFile != "" {
+		v.trustedProducers = map[string]bool{}
+		for _, id := range strings.Split(*trustedProducers, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				v.trustedProducers[id] = true
+			}
+		}
+		if *trustedProducersFile != "" {
+			ids, err := loadProducerList(*trustedProducersFile)
+			if err != nil {
+				failTooling("TRUSTED_PRODUCERS_LOAD_ERROR", err)
+			}
+			for _, id := range ids {
+				v.trustedProducers[id] = true
+			}
+		}
+		if len(v.trustedProducers) == 0 {
+			fmt.Fprintln(os.Stderr, "trusted producer list is empty")
+			os.Exit(2)
+		}
+	}
+	if *classRulesPath != "" {
+		rules, err := loadClassRules(*classRulesPath)
+		if err != nil {
+			failTooling("CLASS_RULES_LOAD_ERROR", err)
+		}
+		v.classRules = rules
+	}
+	if *minTTLUnit != "" {
+		if _, err := parseDuration("1"+*minTTLUnit, "min-ttl-granularity"); err != nil {
+			fmt.Fprintf(os.Stderr, "min-ttl-granularity %q must be one of s, m, h, d\n", *minTTLUnit)
+			os.Exit(2)
+		}
+		v.minTTLUnit = strings.ToLower(*minTTLUnit)
+	}
+	var skipped []string
+	for _, path := range schemaPaths {
+		schema, code, err := compileSchemaFile(path)
+		if err == nil {
+			code, err = v.checkSchemaID(schema)
+		}
+		if err != nil {
+			if !*schemaBestEffort {
+				failTooling(code, err)
+			}
+			msg := fmt.Sprintf("skipped schema %s: %v", path, err)
+			if _, located := err.(*schemaError); located {
+				msg = fmt.Sprintf("skipped schema %v", err)
+			}
+			skipped = append(skipped, msg)
+			v.setupIssues = append(v.setupIssues, Issue{Code: "SCHEMA_SKIPPED", Message: msg, Severity: severityWarning})
+			continue
+		}
+		v.candidates = append(v.candidates, namedSchema{name: path, schema: schema})
+	}
+	if len(schemaPaths) > 0 && len(v.candidates) == 0 {
+		failTooling("SCHEMA_COMPILE_ERROR", "no --schema compiled: "+strings.Join(skipped, "; "))
+	}
+	if *schemaInline != "" {
+		schema, err := compileInlineSchema(*schemaInline)
+		if err != nil {
+			failTooling("SCHEMA_COMPILE_ERROR", err)
+		}
+		if code, err := v.checkSchemaID(schema); err != nil {
+			failTooling(code, err)
+		}
+		v.candidates = []namedSchema{{name: "inline", schema: schema}}
+	}
+	if *schemaBundle != "" {
+		schema, code, err := compileSchemaBundle(*schemaBundle, *schemaRoot)
+		if err == nil {
+			code, err = v.checkSchemaID(schema)
+		}
+		if err != nil {
+			failTooling(code, err)
+		}
+		v.candidates = []namedSchema{{name: *schemaBundle + "#" + *schemaRoot, schema: schema}}
+	}
+	kinds := map[string]namedSchema{}
+	if *kindSchemas != "" {
+		if *serveAddr == "" {
+			fmt.Fprintln(os.Stderr, "--schemas requires --serve")
+			os.Exit(2)
+		}
+		for _, expr := range strings.Split(*kindSchemas, ",") {
+			kind, file, ok := strings.Cut(strings.TrimSpace(expr), "=")
+			if !ok || kind == "" || file == "" {
+				fmt.Fprintf(os.Stderr, "schemas entry %q must be of the form kind=path\n", expr)
+				os.Exit(2)
+			}
+			if _, dup := kinds[kind]; dup {
+				fmt.Fprintf(os.Stderr, "schemas lists kind %q more than once\n", kind)
+				os.Exit(2)
+			}
+			schema, code, err := compileSchemaFile(file)
+			if err == nil {
+				code, err = v.checkSchemaID(schema)
+			}
+			if err != nil {
+				failTooling(code, fmt.Sprintf("kind %s: %v", kind, err))
+			}
+			kinds[kind] = namedSchema{name: file, schema: schema}
+		}
+	}
+
+	var clockOffset time.Duration
+	if *fips && !fips140.Enabled() {
+		failTooling("FIPS_MODE_UNAVAILABLE", "--fips requires the Go FIPS 140-3 module; run with GODEBUG=fips140=on or build with GOFIPS140 set")
+	}
+	if *ntpServer != "" {
+		offset, err := queryNTP(*ntpServer, ntpTimeout)
+		if err != nil {
+			failTooling("CLOCK_UNTRUSTED", fmt.Sprintf("ntp query to %s failed: %v", *ntpServer, err))
+		}
+		if offset > ntpMaxOffset || offset < -ntpMaxOffset {
+			failTooling("CLOCK_UNTRUSTED", fmt.Sprintf("local clock is off by %v according to %s (max %v)", offset, *ntpServer, ntpMaxOffset))
+		}
+		clockOffset = offset
+	}
+	clock := func() time.Time { return time.Now().UTC().Add(clockOffset) }
+	now := clock()
+
+	var audit *auditLog
+	if *auditLogPath != "" {
+		audit, err = openAuditLog(*auditLogPath)
+		if err != nil {
+			failTooling("AUDIT_WRITE_ERROR", err)
+		}
+	}
+
+	if *serveAddr != "" {
+		handler := newServer(v, clock, *maxInflight, queueTimeout, *maxBodySize)
+		handler.kinds = kinds
+		handler.audit = audit
+		srv := &http.Server{
+			Addr:              *serveAddr,
+			Handler:           handler.routes(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		if *grpcAddr != "" {
+			lis, err := net.Listen("tcp", *grpcAddr)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "context-broker: serving gRPC on %s\n", *grpcAddr)
+			go func() {
+				if err := handler.grpcServer().Serve(lis); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(2)
+				}
+			}()
+		}
+		fmt.Fprintf(os.Stderr, "context-broker: listening on %s\n", *serveAddr)
+		if err := srv.ListenAndServe(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if batch {
+		report := batchReport{OK: true, Results: []Result{}}
+		if *packetsStdin && !*gateExpiry {
+			report.stream = newResultStream(os.Stdout)
+			report.keepLinks = *linkCheck
+		}
+		visit := func(name string, data []byte, err error) bool {
+			var res Result
+			if err != nil {
+				res = toolingFailure("PACKET_READ_ERROR", err)
+			} else if *gateExpiry {
+				res = v.checkExpiryOnly(data, now)
+			} else {
+				res = v.validate(data, now)
+				if *mapKeyField != "" {
+					if issues := checkMapKey(res.packet, name, *mapKeyField); len(issues) > 0 {
+						res.OK = false
+						res.Issues = append(res.Issues, issues...)
+					}
+				}
+			}
+			res.Packet = name
+			report.add(res)
+			if audit != nil {
+				if err := audit.record(now, name, res); err != nil {
+					report.OK = false
+					report.tooling = true
+					report.Issues = append(report.Issues, Issue{Code: "AUDIT_WRITE_ERROR", Message: err.Error()})
+				}
+			}
+			if *outputDir != "" {
+				if err := writeResultFile(*outputDir, name, res); err != nil {
+					report.OK = false
+					report.tooling = true
+					report.Issues = append(report.Issues, Issue{Code: "OUTPUT_WRITE_ERROR", Message: err.Error()})
+				}
+			}
+			if *failFastBatch && !res.OK {
+				report.Issues = append(report.Issues, Issue{Code: "FAIL_FAST", Message: fmt.Sprintf("stopped after first failing packet %s", name), Severity: severityInfo})
+				return false
+			}
+			return true
+		}
+		var err error
+		readCode := "PACKET_READ_ERROR"
+		switch {
+		case *tarPath != "":
+			report.Skipped, report.Capped, err = eachTarPacket(*tarPath, since, *maxPackets, visit)
+			report.CapHit = report.Capped > 0
+		case *dirPath != "":
+			report.Skipped, report.Capped, err = eachDirPacket(*dirPath, since, *maxPackets, visit)
+			report.CapHit = report.Capped > 0
+		case *objectMapPath != "":
+			var f *os.File
+			if f, err = os.Open(*objectMapPath); err == nil {
+				report.CapHit, err = eachObjectPacket(f, "packet map in "+*objectMapPath, *maxPackets, visit)
+				f.Close()
+			}
+		default:
+			report.CapHit, err = eachArrayPacket(os.Stdin, *maxPackets, visit)
+		}
+		if _, ok := err.(*collectionParseError); ok {
+			readCode = "PACKET_PARSE_ERROR"
+		}
+		if err != nil {
+			report.OK = false
+			report.tooling = true
+			report.Issues = append(report.Issues, Issue{Code: readCode, Message: err.Error()})
+		}
+		switch {
+		case report.Capped > 0:
+			report.Issues = append(report.Issues, Issue{Code: "MAX_PACKETS", Message: fmt.Sprintf("stopped after %d packets; %d more were not read", *maxPackets, report.Capped), Severity: severityInfo})
+		case report.CapHit:
+			report.Issues = append(report.Issues, Issue{Code: "MAX_PACKETS", Message: fmt.Sprintf("stopped after %d packets; the rest of the input was not read", *maxPackets), Severity: severityInfo})
+		}
+		if *linkCheck {
+			if issues := checkLinks(report.Results); len(issues) > 0 {
+				report.OK = false
+				report.Issues = append(report.Issues, issues...)
+			}
+		}
+		if *summaryPath != "" {
+			var buf bytes.Buffer
+			writeReport(&buf, report.summary())
+			if err := writeFileAtomic(*summaryPath, buf.Bytes()); err != nil {
+				report.OK = false
+				report.tooling = true
+				report.Issues = append(report.Issues, Issue{Code: "OUTPUT_WRITE_ERROR", Message: err.Error()})
+			}
+		}
+		switch {
+		case *gateExpiry:
+			emit(report.expiryGate())
+		case report.stream != nil:
+			report.stream.close(&report)
+		default:
+			emit(report)
+		}
+		os.Exit(report.exitCode())
+	}
+
+	var res Result
+	var packetBytes []byte
+	if isURL(*packetPath) {
+		packetBytes, err = fetchPacket(*packetPath, headers, fetchTimeout, *fetchRetries)
+	} else {
+		packetBytes, err = readPacketFile(*packetPath)
+	}
+	if err != nil {
+		res = toolingFailure("PACKET_READ_ERROR", err)
+	} else {
+		res = v.validate(packetBytes, now)
+	}
+	if audit != nil {
+		if err := audit.record(now, *packetPath, res); err != nil {
+			failTooling("AUDIT_WRITE_ERROR", err)
+		}
+	}
+	if *outputDir != "" {
+		name := filepath.Base(*packetPath)
+		if isURL(*packetPath) {
+			name = path.Base(strings.SplitN(*packetPath, "?", 2)[0])
+		}
+		if err := writeResultFile(*outputDir, name, res); err != nil {
+			failTooling("OUTPUT_WRITE_ERROR", err)
+		}
+	}
+	if *getPointer != "" && res.OK {
+		val, ok := resolvePointer(res.packet, *getPointer)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "packet is valid but has no value at %s\n", *getPointer)
+			os.Exit(3)
+		}
+		printValue(os.Stdout, val)
+		os.Exit(0)
+	}
+	emit(res)
+	os.Exit(res.exitCode())
+}
+
+func runSchemaLint(args []string) int {
+	fs := flag.NewFlagSet("schema-lint", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "Exit with 1 when any finding is reported")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: schema-lint [--strict] SCHEMA")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	schema, code, err := compileSchemaFile(fs.Arg(0))
+	if err != nil {
+		failTooling(code, err)
+	}
+
+	res := Result{OK: true, Issues: lintSchema(schema)}
+	emit(res)
+	if *strict && len(res.Issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// lintSchema reports constructs that make a schema accept more than its
+// authors likely intended. Paths are JSON pointers into the schema document.
+func lintSchema(root *jsonschema.Schema) []Issue {
+	issues := []Issue{}
+	warn := func(code, path, msg string) {
+		issues = append(issues, Issue{Code: code, Message: msg, Path: path, Severity: severityWarning})
+	}
+
+	switch ap := root.AdditionalProperties.(type) {
+	case nil:
+		warn("SCHEMA_ADDITIONAL_PROPERTIES", "/additionalProperties", "additionalProperties is not set at the root, so unknown fields are accepted")
+	case bool:
+		if ap {
+			warn("SCHEMA_ADDITIONAL_PROPERTIES", "/additionalProperties", "additionalProperties is true at the root, so unknown fields are accepted")
+		}
+	}
+	if len(root.Required) == 0 {
+		warn("SCHEMA_REQUIRED_EMPTY", "/required", "no properties are required at the root")
+	}
+
+	visited := map[*jsonschema.Schema]bool{}
+	var walk func(s *jsonschema.Schema, path string)
+	walk = func(s *jsonschema.Schema, path string) {
+		if s == nil || visited[s] {
+			return
+		}
+		visited[s] = true
+		if s.Ref != nil {
+			walk(s.Ref, path)
+			return
+		}
+		if len(s.Types) == 0 && s.Always == nil && len(s.Enum) == 0 && len(s.Constant) == 0 &&
+			len(s.AllOf) == 0 && len(s.AnyOf) == 0 && len(s.OneOf) == 0 {
+			at := path
+			if at == "" {
+				at = "/"
+			}
+			warn("SCHEMA_TYPE_MISSING", path+"/type", fmt.Sprintf("schema at %s does not declare a type", at))
+		}
+		if s.Always != nil && *s.Always {
+			warn("SCHEMA_TYPE_MISSING", path, fmt.Sprintf("schema at %s is `true` and accepts any value", path))
+		}
+		for _, name := range sortedKeys(s.Properties) {
+			walk(s.Properties[name], path+"/properties/"+escapePointer(name))
+		}
+		if items, ok := s.Items.(*jsonschema.Schema); ok {
+			walk(items, path+"/items")
+		}
+		walk(s.Items2020, path+"/items")
+	}
+	walk(root, "")
+	return issues
+}
+
+func runSchemaDiff(args []string) int {
+	fs := flag.NewFlagSet("schema-diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: schema-diff OLD_SCHEMA NEW_SCHEMA")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	oldSchema, err := loadJSONObject(fs.Arg(0))
+	if err != nil {
+		failTooling("SCHEMA_LOAD_ERROR", err)
+	}
+	newSchema, err := loadJSONObject(fs.Arg(1))
+	if err != nil {
+		failTooling("SCHEMA_LOAD_ERROR", err)
+	}
+
+	issues := diffSchemas(oldSchema, newSchema, "")
+	res := Result{OK: !hasErrors(issues), Issues: issues}
+	emit(res)
+	if !res.OK {
+		return 1
+	}
+	return 0
+}
+
+func runExplainField(args []string) int {
+	fs := flag.NewFlagSet("explain-field", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: explain-field SCHEMA FIELD (a JSON pointer such as /payload/sensor/value, or a dotted path)")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	schema, code, err := compileSchemaFile(fs.Arg(0))
+	if err != nil {
+		failTooling(code, err)
+	}
+	field := fs.Arg(1)
+	if !strings.HasPrefix(field, "/") {
+		field = fieldPointer(field)
+	}
+
+	issues := explainField(schema, field)
+	res := Result{OK: !hasErrors(issues), Issues: issues}
+	emit(res)
+	if !res.OK {
+		return 1
+	}
+	return 0
+}
+
+// exitCode describes one process exit status, or a range of them when Max is
+// set.
+type exitCode struct {
+	Code    int    `json:"code"`
+	Max     int    `json:"max,omitempty"`
+	Meaning string `json:"meaning"`
+}
+
+// exitCodes is the table printed by the exit-codes subcommand; keep it in
+// step with docs/go-validator.md.
+var exitCodes = []exitCode{
+	{Code: 0, Meaning: "Every packet is valid (health: the server is healthy)"},
+	{Code: 1, Meaning: "A packet is invalid, or a batch-wide check such as --check-links failed (health: the server is unhealthy or unreachable)"},
+	{Code: 2, Meaning: "Tooling error: bad arguments, unreadable input, a schema that fails to load, or a failing dependency such as --audit-log or --policy-url"},
+	{Code: 3, Meaning: "The packet is valid but the --get pointer does not resolve"},
+	{Code: exitCapped, Meaning: "A batch run stopped at --max-packets, and every packet validated was valid"},
+	{Code: 1, Max: maxCountExit, Meaning: "With --count-exit, the number of invalid packets, capped at 125"},
+}
+
+func runExitCodes(args []string) int {
+	fs := flag.NewFlagSet("exit-codes", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format: text or json")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: exit-codes [--format text|json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	switch *format {
+	case "json":
+		emit(exitCodes)
+	case "text":
+		for _, c := range exitCodes {
+			code := strconv.Itoa(c.Code)
+			if c.Max != 0 {
+				code = fmt.Sprintf("%d-%d", c.Code, c.Max)
+			}
+			fmt.Printf("%-7s %s\n", code, c.Meaning)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "format must be text or json, not %q\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// runHealth probes a running server's /healthz, for use as a container
+// healthcheck command: 0 when healthy, 1 otherwise.
+func runHealth(args []string) int {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "Give up on the probe after this long")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: health [--timeout DUR] ADDR (the --serve address, e.g. :8080, or a full URL)")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	url := fs.Arg(0)
+	if !isURL(url) {
+		if strings.HasPrefix(url, ":") {
+			url = "localhost" + url
+		}
+		url = "http://" + url + "/healthz"
+	}
+	if _, err := fetchPacket(url, nil, *timeout, 0); err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		return 1
+	}
+	return 0
+}
+
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	migrationPath := fs.String("migration", "", "JSON file of declarative steps that rewrite the packet")
+	schemaPath := fs.String("schema", "", "Path to the target JSON Schema. Overrides --schemas-dir")
+	schemasDir := fs.String("schemas-dir", "schemas", "Path to directory containing JSON Schema files")
+	noTime := fs.Bool("no-time", false, "Skip the created_at, ttl, and expires_at rules on the migrated packet")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: migrate --migration FILE [--schema PATH | --schemas-dir DIR] [--no-time] PACKET")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *migrationPath == "" {
+		fs.Usage()
+		return 2
+	}
+
+	m, err := loadMigration(*migrationPath)
+	if err != nil {
+		failTooling("MIGRATION_LOAD_ERROR", err)
+	}
+	data, err := readPacketFile(fs.Arg(0))
+	if err != nil {
+		failTooling("PACKET_READ_ERROR", err)
+	}
+	var packet map[string]any
+	if err := json.Unmarshal(data, &packet); err != nil {
+		failTooling("PACKET_PARSE_ERROR", err)
+	}
+	if packet == nil {
+		failTooling("PACKET_PARSE_ERROR", "packet must be a JSON object")
+	}
+
+	v := &validator{
+		schemasDir:  *schemasDir,
+		clockSkew:   time.Minute,
+		expirySkew:  time.Minute,
+		allowFuture: 5 * time.Minute,
+		noTime:      *noTime,
+		schemas:     map[string]*jsonschema.Schema{},
+	}
+	if *schemaPath != "" {
+		schema, code, err := compileSchemaFile(*schemaPath)
+		if err != nil {
+			failTooling(code, err)
+		}
+		v.candidates = []namedSchema{{name: *schemaPath, schema: schema}}
+	}
+
+	if issues := m.apply(packet); len(issues) > 0 {
+		res := Result{Issues: issues}
+		emit(res)
+		return res.exitCode()
+	}
+	migrated, err := json.Marshal(packet)
+	if err != nil {
+		failTooling("PACKET_PARSE_ERROR", err)
+	}
+	res := v.validate(migrated, time.Now().UTC())
+	if !res.OK {
+		emit(res)
+		return res.exitCode()
+	}
+	printValue(os.Stdout, packet)
+	return 0
+}
+
+// migration is a --migration file: ordered steps, then an optional new
+// schema_version.
+type migration struct {
+	SchemaVersion string          `json:"schema_version"`
+	Steps         []migrationStep `json:"steps"`
+}
+
+// migrationStep is one rewrite. "rename" gives a field at the dotted path
+// From the new name To under the same parent; "move" relocates it to the
+// dotted path To; "default" sets Field to Value when it is absent.
+type migrationStep struct {
+	Op    string `json:"op"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Field string `json:"field"`
+	Value any    `json:"value"`
+}
+
+func loadMigration(path string) (*migration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m migration
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid migration in %s: %v", path, err)
+	}
+	for i, st := range m.Steps {
+		switch st.Op {
+		case "rename", "move":
+			if st.From == "" || st.To == "" {
+				return nil, fmt.Errorf("%s: step %d: %s needs from and to", path, i, st.Op)
+			}
+			if st.Op == "rename" && strings.Contains(st.To, ".") {
+				return nil, fmt.Errorf("%s: step %d: rename target %q must be a field name; use move to change parents", path, i, st.To)
+			}
+		case "default":
+			if st.Field == "" || st.Value == nil {
+				return nil, fmt.Errorf("%s: step %d: default needs field and value", path, i)
+			}
+		default:
+			return nil, fmt.Errorf("%s: step %d: unknown op %q (want rename, move, or default)", path, i, st.Op)
+		}
+	}
+	return &m, nil
+}
+
+// apply rewrites packet in place. A step whose source is absent is skipped,
+// so a migration can be re-run on packets it already converted. A step that
+// would overwrite an existing field fails with MIGRATION_CONFLICT.
+func (m *migration) apply(packet map[string]any) []Issue {
+	var issues []Issue
+	for i, st := range m.Steps {
+		if st.Op == "default" {
+			if _, ok := lookupField(packet, st.Field); !ok {
+				if err := setField(packet, st.Field, st.Value); err != nil {
+					issues = append(issues, Issue{Code: "MIGRATION_CONFLICT", Message: fmt.Sprintf("step %d: %v", i, err), Path: fieldPointer(st.Field)})
+				}
+			}
+			continue
+		}
+		val, ok := lookupField(packet, st.From)
+		if !ok {
+			continue
+		}
+		target := st.To
+		if st.Op == "rename" {
+			if dot := strings.LastIndex(st.From, "."); dot >= 0 {
+				target = st.From[:dot+1] + st.To
+			}
+		}
+		if _, taken := lookupField(packet, target); taken {
+			issues = append(issues, Issue{Code: "MIGRATION_CONFLICT", Message: fmt.Sprintf("step %d: cannot %s %s to %s: %s already present", i, st.Op, st.From, target, target), Path: fieldPointer(target)})
+			continue
+		}
+		deleteField(packet, st.From)
+		if err := setField(packet, target, val); err != nil {
+			issues = append(issues, Issue{Code: "MIGRATION_CONFLICT", Message: fmt.Sprintf("step %d: %v", i, err), Path: fieldPointer(target)})
+		}
+	}
+	if m.SchemaVersion != "" {
+		packet["schema_version"] = m.SchemaVersion
+	}
+	return issues
+}
+
+// appliedSchema is a subschema that constrains a field, with a note when it
+// only applies under a condition such as one branch of anyOf.
+type appliedSchema struct {
+	s    *jsonschema.Schema
+	cond string
+}
+
+// explainField lists, as info issues, every constraint the schema places on
+// the instance at ptr. Issue paths are JSON pointers into the schema.
+func explainField(root *jsonschema.Schema, ptr string) []Issue {
+	current := expandSchema(root, "", map[*jsonschema.Schema]bool{})
+	var tokens []string
+	if ptr != "" && ptr != "/" {
+		tokens = strings.Split(strings.TrimPrefix(ptr, "/"), "/")
+	}
+	parent := ""
+	required := false
+	for _, token := range tokens {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		var next []appliedSchema
+		required = false
+		seen := map[*jsonschema.Schema]bool{}
+		for _, a := range current {
+			if a.cond == "" && containsString(a.s.Required, token) {
+				required = true
+				parent = schemaPointer(a.s)
+			}
+			for _, child := range childSchemas(a.s, token) {
+				next = append(next, expandSchema(child, a.cond, seen)...)
+			}
+		}
+		if len(next) == 0 {
+			for _, a := range current {
+				if ap, ok := a.s.AdditionalProperties.(bool); ok && !ap {
+					at := schemaPointer(a.s)
+					if at == "" {
+						at = "the root schema"
+					}
+					return []Issue{{Code: "FIELD_NOT_ALLOWED", Message: fmt.Sprintf("%s is not allowed: %s sets additionalProperties to false", ptr, at), Path: ptr}}
+				}
+			}
+			return []Issue{{Code: "FIELD_UNCONSTRAINED", Message: fmt.Sprintf("no schema describes %s, so any value is accepted", ptr), Path: ptr, Severity: severityInfo}}
+		}
+		current = next
+	}
+
+	issues := []Issue{}
+	add := func(a appliedSchema, code, keyword, msg string) {
+		if a.cond != "" {
+			msg += " (" + a.cond + ")"
+		}
+		issues = append(issues, Issue{Code: code, Message: msg, Path: schemaPointer(a.s) + "/" + keyword, Severity: severityInfo})
+	}
+	if len(tokens) > 0 {
+		if required {
+			issues = append(issues, Issue{Code: "FIELD_REQUIRED", Message: "required", Path: parent + "/required", Severity: severityInfo})
+		} else {
+			issues = append(issues, Issue{Code: "FIELD_OPTIONAL", Message: "optional", Severity: severityInfo})
+		}
+	}
+	for _, a := range current {
+		s := a.s
+		if len(s.Types) > 0 {
+			add(a, "FIELD_TYPE", "type", strings.Join(s.Types, " or "))
+		}
+		if len(s.Constant) > 0 {
+			add(a, "FIELD_CONST", "const", fmt.Sprintf("must equal %s", jsonText(s.Constant[0])))
+		}
+		if len(s.Enum) > 0 {
+			vals := make([]string, len(s.Enum))
+			for i, e := range s.Enum {
+				vals[i] = jsonText(e)
+			}
+			add(a, "FIELD_ENUM", "enum", "one of "+strings.Join(vals, ", "))
+		}
+		if s.Format != "" {
+			add(a, "FIELD_FORMAT", "format", s.Format)
+		}
+		if s.Pattern != nil {
+			add(a, "FIELD_PATTERN", "pattern", fmt.Sprintf("matches %s", s.Pattern))
+		}
+		if s.MinLength >= 0 {
+			add(a, "FIELD_MIN_LENGTH", "minLength", fmt.Sprintf("at least %d characters", s.MinLength))
+		}
+		if s.MaxLength >= 0 {
+			add(a, "FIELD_MAX_LENGTH", "maxLength", fmt.Sprintf("at most %d characters", s.MaxLength))
+		}
+		if s.Minimum != nil {
+			add(a, "FIELD_MINIMUM", "minimum", ">= "+ratText(s.Minimum))
+		}
+		if s.ExclusiveMinimum != nil {
+			add(a, "FIELD_MINIMUM", "exclusiveMinimum", "> "+ratText(s.ExclusiveMinimum))
+		}
+		if s.Maximum != nil {
+			add(a, "FIELD_MAXIMUM", "maximum", "<= "+ratText(s.Maximum))
+		}
+		if s.ExclusiveMaximum != nil {
+			add(a, "FIELD_MAXIMUM", "exclusiveMaximum", "< "+ratText(s.ExclusiveMaximum))
+		}
+		if s.MultipleOf != nil {
+			add(a, "FIELD_MULTIPLE_OF", "multipleOf", "multiple of "+ratText(s.MultipleOf))
+		}
+		if s.MinItems >= 0 {
+			add(a, "FIELD_MIN_ITEMS", "minItems", fmt.Sprintf("at least %d items", s.MinItems))
+		}
+		if s.MaxItems >= 0 {
+			add(a, "FIELD_MAX_ITEMS", "maxItems", fmt.Sprintf("at most %d items", s.MaxItems))
+		}
+		if len(s.Required) > 0 {
+			add(a, "FIELD_REQUIRES", "required", "requires "+strings.Join(s.Required, ", "))
+		}
+		if ap, ok := s.AdditionalProperties.(bool); ok && !ap {
+			add(a, "FIELD_CLOSED", "additionalProperties", "no properties beyond those declared")
+		}
+	}
+	return issues
+}
+
+// expandSchema returns s and every subschema that applies to the same
+// instance through $ref and the composition keywords.
+func expandSchema(s *jsonschema.Schema, cond string, seen map[*jsonschema.Schema]bool) []appliedSchema {
+	if s == nil || seen[s] {
+		return nil
+	}
+	seen[s] = true
+	out := []appliedSchema{{s: s, cond: cond}}
+	for _, ref := range []*jsonschema.Schema{s.Ref, s.RecursiveRef, s.DynamicRef} {
+		out = append(out, expandSchema(ref, cond, seen)...)
+	}
+	for _, sub := range s.AllOf {
+		out = append(out, expandSchema(sub, cond, seen)...)
+	}
+	for _, group := range []struct {
+		name string
+		subs []*jsonschema.Schema
+	}{{"anyOf", s.AnyOf}, {"oneOf", s.OneOf}} {
+		for i, sub := range group.subs {
+			out = append(out, expandSchema(sub, joinCond(cond, fmt.Sprintf("%s alternative %d", group.name, i)), seen)...)
+		}
+	}
+	if s.If != nil {
+		out = append(out, expandSchema(s.Then, joinCond(cond, "when if matches"), seen)...)
+		out = append(out, expandSchema(s.Else, joinCond(cond, "when if does not match"), seen)...)
+	}
+	return out
+}
+
+func joinCond(outer, inner string) string {
+	if outer == "" {
+		return inner
+	}
+	return outer + ", " + inner
+}
+
+// childSchemas returns the subschemas that apply to the property or array
+// index named by token.
+func childSchemas(s *jsonschema.Schema, token string) []*jsonschema.Schema {
+	var out []*jsonschema.Schema
+	if prop, ok := s.Properties[token]; ok {
+		out = append(out, prop)
+	}
+	for re, sub := range s.PatternProperties {
+		if re.MatchString(token) {
+			out = append(out, sub)
+		}
+	}
+	if len(out) == 0 {
+		if ap, ok := s.AdditionalProperties.(*jsonschema.Schema); ok {
+			out = append(out, ap)
+		}
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return out
+	}
+	switch items := s.Items.(type) {
+	case *jsonschema.Schema:
+		out = append(out, items)
+	case []*jsonschema.Schema:
+		if i < len(items) {
+			out = append(out, items[i])
+		} else if ai, ok := s.AdditionalItems.(*jsonschema.Schema); ok {
+			out = append(out, ai)
+		}
+	}
+	if i < len(s.PrefixItems) {
+		out = append(out, s.PrefixItems[i])
+	} else if s.Items2020 != nil {
+		out = append(out, s.Items2020)
+	}
+	return out
+}
+
+// enumValues returns the string values of every enum the schema applies to the
+// field at a dotted path.
+func enumValues(root *jsonschema.Schema, path string) []string {
+	current := expandSchema(root, "", map[*jsonschema.Schema]bool{})
+	for _, token := range strings.Split(path, ".") {
+		var next []appliedSchema
+		seen := map[*jsonschema.Schema]bool{}
+		for _, a := range current {
+			for _, child := range childSchemas(a.s, token) {
+				next = append(next, expandSchema(child, a.cond, seen)...)
+			}
+		}
+		current = next
+	}
+	var vals []string
+	for _, a := range current {
+		for _, e := range a.s.Enum {
+			if s, ok := e.(string); ok {
+				vals = append(vals, s)
+			}
+		}
+	}
+	return vals
+}
+
+// foldEnumCase finds the fields whose string value matches exactly one enum
+// value of the candidate schemas, and only when ignoring case. It returns the
+// canonical value for each, keyed by field, with an ENUM_CASE_MISMATCH
+// warning. A value that matches exactly, or ambiguously, is left alone.
+func foldEnumCase(packet map[string]any, candidates []namedSchema, fields []string) (map[string]string, []Issue) {
+	var fixes map[string]string
+	var issues []Issue
+	for _, field := range fields {
+		val, _ := lookupField(packet, field)
+		s, ok := val.(string)
+		if !ok {
+			continue
+		}
+		var vals []string
+		for _, c := range candidates {
+			vals = append(vals, enumValues(c.schema, field)...)
+		}
+		if containsString(vals, s) {
+			continue
+		}
+		folded := map[string]bool{}
+		for _, e := range vals {
+			if strings.EqualFold(e, s) {
+				folded[e] = true
+			}
+		}
+		if len(folded) != 1 {
+			continue
+		}
+		canon := sortedKeys(folded)[0]
+		if fixes == nil {
+			fixes = map[string]string{}
+		}
+		fixes[field] = canon
+		issues = append(issues, Issue{Code: "ENUM_CASE_MISMATCH", Message: fmt.Sprintf("%s %q matches enum value %q only when ignoring case", field, s, canon), Path: fieldPointer(field), Severity: severityWarning})
+	}
+	return fixes, issues
+}
+
+// schemaPointer returns the JSON pointer of s within its schema document.
+func schemaPointer(s *jsonschema.Schema) string {
+	_, frag, _ := strings.Cut(s.Location, "#")
+	return frag
+}
+
+func jsonText(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func ratText(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func loadJSONObject(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("%s must contain a JSON object", path)
+	}
+	return obj, nil
+}
+
+// diffSchemas compares the properties, types, and required sets of two raw
+// schema documents, recursing into nested objects and array items. Changes
+// that can reject packets the old schema accepted are errors; the rest are
+// informational.
+func diffSchemas(oldS, newS map[string]any, path string) []Issue {
+	issues := []Issue{}
+	change := func(code, at, severity, msg string) {
+		issues = append(issues, Issue{Code: code, Message: msg, Path: at, Severity: severity})
+	}
+
+	oldTypes, newTypes := schemaTypes(oldS), schemaTypes(newS)
+	if len(oldTypes) > 0 && strings.Join(oldTypes, ",") != strings.Join(newTypes, ",") {
+		severity := severityInfo
+		for _, t := range oldTypes {
+			if len(newTypes) > 0 && !containsString(newTypes, t) {
+				severity = ""
+			}
+		}
+		label := path
+		if label == "" {
+			label = "root"
+		}
+		change("SCHEMA_PROPERTY_RETYPED", path+"/type", severity, fmt.Sprintf("%s type changed from %s to %s", label, strings.Join(oldTypes, "|"), typesLabel(newTypes)))
+	}
+
+	oldReq, newReq := stringSet(oldS["required"]), stringSet(newS["required"])
+	for _, name := range sortedKeys(newReq) {
+		if !oldReq[name] {
+			change("SCHEMA_REQUIRED_ADDED", path+"/required", "", fmt.Sprintf("%s is newly required", name))
+		}
+	}
+	for _, name := range sortedKeys(oldReq) {
+		if !newReq[name] {
+			change("SCHEMA_REQUIRED_REMOVED", path+"/required", severityInfo, fmt.Sprintf("%s is no longer required", name))
+		}
+	}
+
+	oldProps, _ := oldS["properties"].(map[string]any)
+	newProps, _ := newS["properties"].(map[string]any)
+	for _, name := range sortedKeys(newProps) {
+		if _, ok := oldProps[name]; !ok {
+			change("SCHEMA_PROPERTY_ADDED", path+"/properties/"+escapePointer(name), severityInfo, fmt.Sprintf("property %s was added", name))
+		}
+	}
+	for _, name := range sortedKeys(oldProps) {
+		at := path + "/properties/" + escapePointer(name)
+		newProp, ok := newProps[name]
+		if !ok {
+			change("SCHEMA_PROPERTY_REMOVED", at, "", fmt.Sprintf("property %s was removed", name))
+			continue
+		}
+		oldObj, oldIsObj := oldProps[name].(map[string]any)
+		newObj, newIsObj := newProp.(map[string]any)
+		if oldIsObj && newIsObj {
+			issues = append(issues, diffSchemas(oldObj, newObj, at)...)
+		}
+	}
+
+	oldItems, oldHasItems := oldS["items"].(map[string]any)
+	newItems, newHasItems := newS["items"].(map[string]any)
+	if oldHasItems && newHasItems {
+		issues = append(issues, diffSchemas(oldItems, newItems, path+"/items")...)
+	}
+	return issues
+}
+
+func schemaTypes(s map[string]any) []string {
+	var types []string
+	switch t := s["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func typesLabel(types []string) string {
+	if len(types) == 0 {
+		return "any"
+	}
+	return strings.Join(types, "|")
+}
+
+func stringSet(v any) map[string]bool {
+	set := map[string]bool{}
+	items, _ := v.([]any)
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) validate(packetBytes []byte, now time.Time) Result {
+	return v.validateWith(packetBytes, now, v.candidates)
+}
+
+// validateWith validates against candidates, or the schemasDir lookup when
+// there are none.
+func (v *validator) validateWith(packetBytes []byte, now time.Time, candidates []namedSchema) (res Result) {
+	res = Result{OK: true, Issues: append([]Issue{}, v.setupIssues...)}
+	defer func() { localize(res.Issues, v.catalog) }()
+
+	var packet map[string]any
+	if err := json.Unmarshal(packetBytes, &packet); err != nil {
+		res.failTooling("PACKET_PARSE_ERROR", err)
+		return res
+	}
+	// Set before any check can fail, so batch-level checks such as
+	// checkLinks still see the ids of packets that fail early.
+	res.packet = packet
+	var received []byte // canonical form as received, for --require-canonical
+	if v.requireCanonical {
+		received, _ = canonicalJSON(packet)
+	}
+	v.transform(packet)
+
+	sv, ok := packet["schema_version"].(string)
+	if !ok || strings.TrimSpace(sv) == "" {
+		res.fail("UNSUPPORTED_SCHEMA_VERSION", "Missing or invalid schema_version")
+		return res
+	}
+	res.SchemaVersion = sv
+
+	if len(candidates) == 0 {
+		schema, code, err := v.schemaFor(sv)
+		if err != nil {
+			if code == "UNSUPPORTED_SCHEMA_VERSION" {
+				res.fail(code, err)
+			} else {
+				res.failTooling(code, err)
+			}
+			return res
+		}
+		candidates = []namedSchema{{name: v.schemaPath(sv), schema: schema}}
+	}
+
+	match := matchSchema
+	if v.parallel {
+		match = matchSchemaParallel
+	}
+	// Case fixes only reach the packet itself, and so its canonical form,
+	// with --canonicalize; integrity checks still see the value as sent.
+	target := packet
+	fixes, foldIssues := foldEnumCase(packet, candidates, v.enumCaseFields)
+	if len(fixes) > 0 {
+		target = cloneJSON(packet).(map[string]any)
+		for field, canon := range fixes {
+			setField(target, field, canon)
+		}
+	}
+	res.Issues = append(res.Issues, foldIssues...)
+	matched, issues := match(target, candidates)
+	schema := matched.schema
+	res.Issues = append(res.Issues, issues...)
+	if len(candidates) > 1 {
+		res.Schema = matched.name
+		verbose.Printf("schema: validated against %s", matched.name)
+	}
+	if v.reportSchema {
+		res.Schema = matched.name
+		res.SchemaID = schemaID(schema)
+	}
+
+	// Each stage runs in order; with --fail-fast the first error skips the
+	// rest.
+	stages := []func() []Issue{
+		func() []Issue {
+			if received != nil {
+				return checkCanonical(packetBytes, received)
+			}
+			return nil
+		},
+		func() []Issue {
+			if issues := checkAlgKey(packet); len(issues) > 0 {
+				return issues
+			}
+			if err := verifyIntegrity(packet); err != nil {
+				return []Issue{{Code: "INTEGRITY_FAILURE", Message: err.Error()}}
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.sigFieldsAllOrNone {
+				return checkSignatureFields(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.fips {
+				return checkAlgorithms(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.trustedProducers != nil {
+				return checkProducer(packet, v.trustedProducers)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.checkContentLength {
+				return checkContentLength(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.checkContentType {
+				return checkContentType(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			// Defaults are filled after the signature is checked against the
+			// packet as received.
+			if v.applyDefaults {
+				fillDefaults(schema, packet, "")
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.rejectSubnano {
+				return checkSubnano(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.warnWhitespace {
+				return checkWhitespace(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.noTime {
+				return nil
+			}
+			return v.checkTime(packet, now)
+		},
+		func() []Issue {
+			if v.noTime {
+				return nil
+			}
+			return v.checkSignedAt(packet)
+		},
+		func() []Issue {
+			if !v.expireBefore.IsZero() {
+				return checkExpireBefore(packet, v.expireBefore)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.consistentTZ {
+				return checkConsistentTZ(packet)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.epochInterval > 0 {
+				return checkEpoch(packet, v.epochInterval)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.classRules != nil {
+				return checkClassTTL(packet, v.classRules)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.deriveTTL != nil {
+				return checkDerivedTTL(packet, v.deriveTTL)
+			}
+			return nil
+		},
+		func() []Issue {
+			if v.minTTLUnit != "" {
+				return checkTTLGranularity(packet, v.minTTLUnit)
+			}
+			return nil
+		},
+	}
+	for _, fields := range v.dateOrders {
+		fields := fields
+		stages = append(stages, func() []Issue { return checkDateOrder(packet, fields) })
+	}
+	for _, field := range v.durationFields {
+		field := field
+		stages = append(stages, func() []Issue { return checkDurationField(packet, field) })
+	}
+	for _, rule := range v.semverRules {
+		rule := rule
+		stages = append(stages, func() []Issue { return checkSemver(packet, rule) })
+	}
+	for _, limit := range v.arrayLimits {
+		limit := limit
+		stages = append(stages, func() []Issue { return checkArrayLength(packet, limit) })
+	}
+	if v.maxDepth > 0 {
+		stages = append(stages, func() []Issue { return checkDepth(packet, v.maxDepthField, v.maxDepth) })
+	}
+	if v.metadataField != "" {
+		stages = append(stages, func() []Issue { return checkMetadataKeys(packet, v.metadataField, v.metadataKeyRe) })
+	}
+	if v.midnightThreshold > 0 {
+		stages = append(stages, func() []Issue { return checkMidnightUTC(packet, v.midnightThreshold) })
+	}
+	if v.warnUnusedFields {
+		stages = append(stages, func() []Issue { return unusedFields(schema, packet, "") })
+	}
+	for _, c := range v.checks {
+		stages = append(stages, func() []Issue { return c.Run(packet, now) })
+	}
+
+	for _, stage := range stages {
+		if v.failFast && hasErrors(res.Issues) {
+			break
+		}
+		res.Issues = append(res.Issues, stage()...)
+	}
+	if v.failFast {
+		res.Issues = firstError(res.Issues)
+	}
+
+	// The policy service only decides on packets the built-in checks accept.
+	if v.policy != nil && !hasErrors(res.Issues) {
+		if is, tooling := v.checkPolicy(packet); is != nil {
+			res.Issues = append(res.Issues, *is)
+			res.tooling = res.tooling || tooling
+		}
+	}
+
+	// Only packets that pass every other check are recorded, so an invalid
+	// packet cannot burn the identifier of a legitimate one.
+	if v.replay != nil && !hasErrors(res.Issues) {
+		if is, tooling := v.checkReplay(packet, now); is != nil {
+			res.Issues = append(res.Issues, *is)
+			res.tooling = res.tooling || tooling
+		}
+	}
+
+	if v.canonicalize {
+		for field, canon := range fixes {
+			setField(packet, field, canon)
+		}
+		if v.trimStrings {
+			trimStringValues(packet)
+		}
+	}
+	var canonical []byte
+	if v.canonicalize || v.emitChecksum {
+		if b, err := canonicalJSON(packet); err == nil {
+			canonical = b
+		}
+	}
+	if v.canonicalize && canonical != nil {
+		res.Canonical = string(canonical)
+	}
+
+	if v.deterministic {
+		sortIssues(res.Issues)
+	}
+	res.OK = !hasErrors(res.Issues)
+	if v.emitChecksum && res.OK && canonical != nil {
+		sum := sha256.Sum256(canonical)
+		res.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	res.Issues = truncateIssues(res.Issues, v.maxIssues)
+	return res
+}
+
+// matchSchema returns the first candidate that accepts the packet or, if none
+// does, the one reporting the fewest violations, along with its issues.
+func matchSchema(packet map[string]any, candidates []namedSchema) (namedSchema, []Issue) {
+	var best namedSchema
+	var bestIssues []Issue
+	for i, c := range candidates {
+		var issues []Issue
+		if err := c.schema.Validate(packet); err != nil {
+			issues = schemaIssues(err)
+		}
+		if i == 0 || len(issues) < len(bestIssues) {
+			best, bestIssues = c, issues
+		}
+		if len(issues) == 0 {
+			break
+		}
+	}
+	return best, bestIssues
+}
+
+// matchSchemaParallel picks the same candidate as matchSchema but validates
+// against all of them at once. It returns as soon as a candidate accepts the
+// packet and every earlier one has rejected it, so a later match never wins
+// over an earlier one. Validate cannot be interrupted, so the remaining
+// candidates finish in the background against a copy of the packet, which
+// leaves the caller free to modify the original.
+func matchSchemaParallel(packet map[string]any, candidates []namedSchema) (namedSchema, []Issue) {
+	if len(candidates) < 2 {
+		return matchSchema(packet, candidates)
+	}
+	shared := cloneJSON(packet).(map[string]any)
+	type outcome struct {
+		i      int
+		issues []Issue
+	}
+	done := make(chan outcome, len(candidates))
+	for i, c := range candidates {
+		go func(i int, c namedSchema) {
+			var issues []Issue
+			if err := c.schema.Validate(shared); err != nil {
+				issues = schemaIssues(err)
+			}
+			done <- outcome{i, issues}
+		}(i, c)
+	}
+
+	results := make([][]Issue, len(candidates))
+	finished := make([]bool, len(candidates))
+	next := 0 // lowest candidate not yet known to reject the packet
+	for range candidates {
+		o := <-done
+		results[o.i], finished[o.i] = o.issues, true
+		for next < len(candidates) && finished[next] {
+			if len(results[next]) == 0 {
+				return candidates[next], nil
+			}
+			next++
+		}
+	}
+	best := 0
+	for i := range results {
+		if len(results[i]) < len(results[best]) {
+			best = i
+		}
+	}
+	return candidates[best], results[best]
+}
+
+// schemaFor returns the compiled schema in schemasDir for a packet declaring
+// version sv, along with the issue code to report if it cannot be loaded.
+// Compiled schemas are cached and are safe to share between goroutines.
+func (v *validator) schemaFor(sv string) (*jsonschema.Schema, string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if schema, ok := v.schemas[sv]; ok {
+		return schema, "", nil
+	}
+	schemaPath := v.schemaPath(sv)
+	if _, err := os.Stat(schemaPath); os.IsNotExist(err) {
+		return nil, "UNSUPPORTED_SCHEMA_VERSION", fmt.Errorf("Unsupported schema version: %s", sv)
+	}
+	schema, code, err := compileSchemaFile(schemaPath)
+	if err == nil {
+		code, err = v.checkSchemaID(schema)
+	}
+	if err != nil {
+		return nil, code, err
+	}
+	v.schemas[sv] = schema
+	return schema, "", nil
+}
+
+func (v *validator) schemaPath(sv string) string {
+	return fmt.Sprintf("%s/context_packet.schema.v%s.json", v.schemasDir, sv)
+}
+
+// schemaID returns the root $id of schema, or "" when it has none and is
+// located at the resource it was compiled from.
+func schemaID(schema *jsonschema.Schema) string {
+	loc := strings.TrimSuffix(schema.Location, "#")
+	if strings.HasPrefix(loc, "file://") || strings.HasPrefix(loc, "bundle:///") {
+		return ""
+	}
+	return loc
+}
+
+// checkSchemaID guards against a templated path that resolves to an unrelated
+// schema which happens to compile. The compiler reports the root $id as the
+// schema's location; a schema without one is located at the file it was
+// loaded from, which never matches.
+func (v *validator) checkSchemaID(schema *jsonschema.Schema) (string, error) {
+	if v.expectSchemaID == "" {
+		return "", nil
+	}
+	if got := strings.TrimSuffix(schema.Location, "#"); got != strings.TrimSuffix(v.expectSchemaID, "#") {
+		return "SCHEMA_ID_MISMATCH", fmt.Errorf("schema $id is %s, want %s", got, v.expectSchemaID)
+	}
+	return "", nil
+}
+
+// transform rewrites legacy packet shapes before any check sees them. It runs
+// ahead of signature verification, so it will break signatures over the
+// original form.
+func (v *validator) transform(packet map[string]any) {
+	for _, r := range v.renames {
+		val, ok := packet[r.from]
+		if !ok {
+			continue
+		}
+		if _, taken := packet[r.to]; taken {
+			verbose.Printf("transform: not renaming %s to %s: %s already present", r.from, r.to, r.to)
+			continue
+		}
+		delete(packet, r.from)
+		packet[r.to] = val
+		verbose.Printf("transform: renamed %s to %s", r.from, r.to)
+	}
+
+	if v.coerceTTLSeconds {
+		secs, ok := packet["ttl"].(float64)
+		if ok && secs > 0 && secs == math.Trunc(secs) && secs <= float64(math.MaxInt64/int64(time.Second)) {
+			ttl := formatTTL(time.Duration(secs) * time.Second)
+			packet["ttl"] = ttl
+			verbose.Printf("transform: coerced ttl %d seconds to %q", int64(secs), ttl)
+		}
+	}
+
+	if v.deriveTTL != nil && v.canonicalize {
+		if _, present := packet["ttl"]; !present {
+			if d, is := v.deriveTTL.window(packet); is == nil && d > 0 {
+				packet["ttl"] = formatTTL(d)
+				verbose.Printf("transform: derived ttl %q from %s and %s", packet["ttl"], v.deriveTTL.from, v.deriveTTL.until)
+			}
+		}
+	}
+}
+
+// ttlDerivation names the timestamp fields whose difference a packet's ttl
+// must equal, for --derive-ttl.
+type ttlDerivation struct {
+	from, until string
+}
+
+func parseTTLDerivation(expr string) (*ttlDerivation, error) {
+	d := &ttlDerivation{}
+	for _, part := range strings.Split(expr, ",") {
+		key, field, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch {
+		case field == "":
+			return nil, fmt.Errorf("%q must be key=FIELD", part)
+		case key == "from":
+			d.from = field
+		case key == "until":
+			d.until = field
+		default:
+			return nil, fmt.Errorf("unknown key %q (want from and until)", key)
+		}
+	}
+	if d.from == "" || d.until == "" {
+		return nil, errors.New("both from=FIELD and until=FIELD are required")
+	}
+	return d, nil
+}
+
+// window returns until minus from. Packets without either field have no
+// window, and yield neither a duration nor an issue.
+func (d *ttlDerivation) window(packet map[string]any) (time.Duration, *Issue) {
+	var times [2]time.Time
+	for i, field := range []string{d.from, d.until} {
+		val, ok := lookupField(packet, field)
+		if !ok {
+			return 0, nil
+		}
+		s, _ := val.(string)
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, &Issue{Code: "TTL_DERIVATION_MISMATCH", Message: fmt.Sprintf("%s must be an RFC3339 timestamp (required by --derive-ttl)", field), Path: fieldPointer(field)}
+		}
+		times[i] = t
+	}
+	return times[1].Sub(times[0]), nil
+}
+
+// checkDerivedTTL requires a present ttl to equal the window to the second.
+// An unparseable ttl is left to checkTime.
+func checkDerivedTTL(packet map[string]any, d *ttlDerivation) []Issue {
+	window, is := d.window(packet)
+	if is != nil {
+		return []Issue{*is}
+	}
+	s, ok := packet["ttl"].(string)
+	if !ok {
+		return nil
+	}
+	window = window.Truncate(time.Second)
+	if window <= 0 {
+		return []Issue{{Code: "TTL_DERIVATION_MISMATCH", Message: fmt.Sprintf("%s must be after %s", d.until, d.from), Path: fieldPointer(d.until)}}
+	}
+	ttl, err := parseDuration(s, "ttl")
+	if err != nil {
+		return nil
+	}
+	if ttl != window {
+		return []Issue{{Code: "TTL_DERIVATION_MISMATCH", Message: fmt.Sprintf("ttl is %s but %s - %s is %s", s, d.until, d.from, formatTTL(window)), Path: "/ttl"}}
+	}
+	return nil
+}
+
+// fillDefaults sets every absent property that declares a schema default,
+// recursing into objects that are present. Present keys are never replaced.
+func fillDefaults(s *jsonschema.Schema, obj map[string]any, path string) {
+	for s != nil && s.Ref != nil {
+		s = s.Ref
+	}
+	if s == nil {
+		return
+	}
+	for _, name := range sortedKeys(s.Properties) {
+		prop := s.Properties[name]
+		for prop.Ref != nil {
+			prop = prop.Ref
+		}
+		val, present := obj[name]
+		if !present {
+			if prop.Default != nil {
+				obj[name] = cloneJSON(prop.Default)
+				verbose.Printf("defaults: filled %s/%s from schema default", path, escapePointer(name))
+			}
+			continue
+		}
+		if child, ok := val.(map[string]any); ok {
+			fillDefaults(prop, child, path+"/"+escapePointer(name))
+		}
+	}
+}
+
+// unusedFields notes, as info issues, every optional property the schema
+// declares that obj leaves out, recursing into objects that are present like
+// fillDefaults.
+func unusedFields(s *jsonschema.Schema, obj map[string]any, path string) []Issue {
+	for s != nil && s.Ref != nil {
+		s = s.Ref
+	}
+	if s == nil {
+		return nil
+	}
+	var issues []Issue
+	for _, name := range sortedKeys(s.Properties) {
+		prop := s.Properties[name]
+		for prop.Ref != nil {
+			prop = prop.Ref
+		}
+		ptr := path + "/" + escapePointer(name)
+		val, present := obj[name]
+		if !present {
+			if !containsString(s.Required, name) {
+				issues = append(issues, Issue{Code: "FIELD_UNUSED", Message: fmt.Sprintf("schema declares optional %s, which the packet does not set", ptr), Path: ptr, Severity: severityInfo})
+			}
+			continue
+		}
+		if child, ok := val.(map[string]any); ok {
+			issues = append(issues, unusedFields(prop, child, ptr)...)
+		}
+	}
+	return issues
+}
+
+// cloneJSON deep-copies a decoded JSON value so schema defaults are never
+// shared between packets.
+func cloneJSON(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = cloneJSON(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = cloneJSON(item)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+// canonicalJSON is the single canonical serialization used for signatures
+// and --canonicalize: object keys sorted, no insignificant whitespace.
+func canonicalJSON(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// checkCanonical compares the packet's source, with insignificant whitespace
+// removed, to its canonical form.
+func checkCanonical(raw, canonical []byte) []Issue {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return nil
+	}
+	got := compact.Bytes()
+	if bytes.Equal(got, canonical) {
+		return nil
+	}
+	i := 0
+	for i < len(got) && i < len(canonical) && got[i] == canonical[i] {
+		i++
+	}
+	return []Issue{{Code: "NOT_CANONICAL", Message: fmt.Sprintf("packet is not in canonical form; first difference at byte %d of the compacted source (see --canonicalize for the expected form)", i)}}
+}
+
+// formatTTL renders d in the canonical <int><unit> form, using the largest
+// unit that divides it exactly.
+func formatTTL(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// checkTime applies the created_at/ttl/expires_at rules. Comparisons only run
+// once all three fields have parsed, mirroring the Python validator.
+func (v *validator) checkTime(packet map[string]any, now time.Time) []Issue {
+	var issues []Issue
+
+	createdAt, createdOK := time.Time{}, false
+	if s, ok := packet["created_at"].(string); !ok {
+		issues = append(issues, Issue{Code: "TIME_INVALID_CREATED_AT", Message: "created_at must be a string", Path: "/created_at"})
+	} else if t, err := time.Parse(time.RFC3339Nano, s); err != nil {
+		issues = append(issues, Issue{Code: "TIME_INVALID_CREATED_AT", Message: err.Error(), Path: "/created_at"})
+	} else {
+		createdAt, createdOK = t, true
+	}
+
+	expiresAt, is := parseExpiresAt(packet)
+	expiresOK := is == nil
+	if is != nil {
+		issues = append(issues, *is)
+	}
+
+	var ttl time.Duration
+	ttlOK := false
+	if s, ok := packet["ttl"].(string); !ok {
+		issues = append(issues, Issue{Code: "TIME_INVALID_TTL", Message: "ttl must be a string", Path: "/ttl"})
+	} else if d, err := parseDuration(s, "ttl"); err != nil {
+		issues = append(issues, Issue{Code: "TIME_INVALID_TTL", Message: err.Error(), Path: "/ttl"})
+	} else {
+		ttl, ttlOK = d, true
+	}
+
+	if !createdOK || !expiresOK || !ttlOK {
+		return issues
+	}
+
+	if ttl > maxTTL {
+		issues = append(issues, Issue{Code: "TTL_TOO_LONG", Message: fmt.Sprintf("ttl exceeds maximum allowed duration (%v)", maxTTL), Path: "/ttl"})
+	}
+
+	expected := createdAt.Add(ttl)
+	diff := expiresAt.Sub(expected)
+	if diff < 0 {
+		diff = -diff
+	}
+	tolerance := v.clockSkew
+	if tolerance < time.Second {
+		tolerance = time.Second
+	}
+	if diff > tolerance {
+		issues = append(issues, Issue{Code: "TIME_MISMATCH", Message: "expires_at != created_at + ttl", Path: "/expires_at"})
+	}
+
+	if createdAt.Sub(now) > v.allowFuture {
+		issues = append(issues, Issue{Code: "TIME_CREATED_AT_IN_FUTURE", Message: "created_at is too far in the future", Path: "/created_at"})
+	}
+
+	if v.expired(expiresAt, now) {
+		issues = append(issues, Issue{Code: "TIME_EXPIRED", Message: "context packet expired", Path: "/expires_at"})
+	}
+
+	return issues
+}
+
+func parseExpiresAt(packet map[string]any) (time.Time, *Issue) {
+	s, ok := packet["expires_at"].(string)
+	if !ok {
+		return time.Time{}, &Issue{Code: "TIME_INVALID_EXPIRES_AT", Message: "expires_at must be a string", Path: "/expires_at"}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, &Issue{Code: "TIME_INVALID_EXPIRES_AT", Message: err.Error(), Path: "/expires_at"}
+	}
+	return t, nil
+}
+
+func (v *validator) expired(expiresAt, now time.Time) bool {
+	return now.Sub(expiresAt) > v.expirySkew
+}
+
+// checkExpiryOnly stands in for validate under --gate-expiry: it parses the
+// packet and applies checkTime's expiry rule, and nothing else.
+func (v *validator) checkExpiryOnly(packetBytes []byte, now time.Time) (res Result) {
+	res = Result{OK: true, Issues: []Issue{}}
+	defer func() { localize(res.Issues, v.catalog) }()
+
+	var packet map[string]any
+	if err := json.Unmarshal(packetBytes, &packet); err != nil {
+		res.failTooling("PACKET_PARSE_ERROR", err)
+		return res
+	}
+	res.packet = packet
+	res.SchemaVersion, _ = packet["schema_version"].(string)
+	expiresAt, is := parseExpiresAt(packet)
+	switch {
+	case is != nil:
+		res.Issues = append(res.Issues, *is)
+	case v.expired(expiresAt, now):
+		res.Issues = append(res.Issues, Issue{Code: "TIME_EXPIRED", Message: "context packet expired", Path: "/expires_at"})
+	}
+	res.OK = !hasErrors(res.Issues)
+	return res
+}
+
+// checkSignedAt requires signed_at, when present, to fall within the packet's
+// lifetime, give or take the clock skew. Unparseable created_at and expires_at
+// are left to checkTime.
+func (v *validator) checkSignedAt(packet map[string]any) []Issue {
+	val, ok := packet["signed_at"]
+	if !ok {
+		return nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return []Issue{{Code: "TIME_INVALID_SIGNED_AT", Message: "signed_at must be a string", Path: "/signed_at"}}
+	}
+	signedAt, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return []Issue{{Code: "TIME_INVALID_SIGNED_AT", Message: err.Error(), Path: "/signed_at"}}
+	}
+	createdStr, _ := packet["created_at"].(string)
+	expiresStr, _ := packet["expires_at"].(string)
+	createdAt, err1 := time.Parse(time.RFC3339Nano, createdStr)
+	expiresAt, err2 := time.Parse(time.RFC3339Nano, expiresStr)
+	if err1 != nil || err2 != nil {
+		return nil
+	}
+	switch {
+	case createdAt.Sub(signedAt) > v.clockSkew:
+		return []Issue{{Code: "SIGNATURE_TIME_OUTSIDE_LIFETIME", Message: fmt.Sprintf("signed_at %s is before created_at %s", s, createdStr), Path: "/signed_at"}}
+	case signedAt.Sub(expiresAt) > v.clockSkew:
+		return []Issue{{Code: "SIGNATURE_TIME_OUTSIDE_LIFETIME", Message: fmt.Sprintf("signed_at %s is after expires_at %s", s, expiresStr), Path: "/signed_at"}}
+	}
+	return nil
+}
+
+// loadClassRules reads a --class-rules file. Bounds use the ttl syntax and
+// may each be omitted.
+func loadClassRules(path string) (map[string]ttlRange, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]struct {
+		MinTTL string `json:"min_ttl"`
+		MaxTTL string `json:"max_ttl"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%s must map at least one class to a ttl range", path)
+	}
+	rules := make(map[string]ttlRange, len(raw))
+	for class, r := range raw {
+		var tr ttlRange
+		if r.MinTTL != "" {
+			if tr.min, err = parseDuration(r.MinTTL, class+".min_ttl"); err != nil {
+				return nil, err
+			}
+		}
+		if r.MaxTTL != "" {
+			if tr.max, err = parseDuration(r.MaxTTL, class+".max_ttl"); err != nil {
+				return nil, err
+			}
+		}
+		if tr.max != 0 && tr.min > tr.max {
+			return nil, fmt.Errorf("%s: min_ttl is greater than max_ttl", class)
+		}
+		rules[class] = tr
+	}
+	return rules, nil
+}
+
+// checkClassTTL requires the packet's ttl to fall within the range for its
+// class. An unparseable ttl is left to checkTime.
+func checkClassTTL(packet map[string]any, rules map[string]ttlRange) []Issue {
+	class, ok := packet["class"].(string)
+	if !ok {
+		return []Issue{{Code: "CLASS_UNKNOWN", Message: "class must be a string (required by --class-rules)", Path: "/class"}}
+	}
+	r, ok := rules[class]
+	if !ok {
+		return []Issue{{Code: "CLASS_UNKNOWN", Message: fmt.Sprintf("class %q is not one of %s", class, strings.Join(sortedKeys(rules), ", ")), Path: "/class"}}
+	}
+	s, _ := packet["ttl"].(string)
+	ttl, err := parseDuration(s, "ttl")
+	if err != nil {
+		return nil
+	}
+	if ttl < r.min {
+		return []Issue{{Code: "CLASS_TTL_VIOLATION", Message: fmt.Sprintf("ttl %s is shorter than the minimum of %s for class %s", formatTTL(ttl), formatTTL(r.min), class), Path: "/ttl"}}
+	}
+	if r.max != 0 && ttl > r.max {
+		return []Issue{{Code: "CLASS_TTL_VIOLATION", Message: fmt.Sprintf("ttl %s is longer than the maximum of %s for class %s", formatTTL(ttl), formatTTL(r.max), class), Path: "/ttl"}}
+	}
+	return nil
+}
+
+// checkTTLGranularity rejects a ttl written in a unit finer than minUnit, no
+// matter its total: "120s" fails a minimum of m even though it is two minutes.
+// An unparseable ttl is left to checkTime.
+func checkTTLGranularity(packet map[string]any, minUnit string) []Issue {
+	s, _ := packet["ttl"].(string)
+	m := ttlRe.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return nil
+	}
+	unit, _ := parseDuration("1"+m[2], "ttl")
+	min, _ := parseDuration("1"+minUnit, "ttl")
+	if unit >= min {
+		return nil
+	}
+	return []Issue{{Code: "TTL_GRANULARITY_TOO_FINE", Message: fmt.Sprintf("ttl %s is in unit %s, finer than the minimum granularity %s", s, m[2], minUnit), Path: "/ttl"}}
+}
+
+// checkExpireBefore enforces the --expire-before deadline, an absolute cap
+// independent of ttl. An unparseable expires_at is left to checkTime.
+func checkExpireBefore(packet map[string]any, deadline time.Time) []Issue {
+	s, _ := packet["expires_at"].(string)
+	expiresAt, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || !expiresAt.After(deadline) {
+		return nil
+	}
+	return []Issue{{Code: "EXPIRY_BEYOND_DEADLINE", Message: fmt.Sprintf("expires_at %s is after the deadline %s", s, deadline.Format(time.RFC3339Nano)), Path: "/expires_at"}}
+}
+
+// checkSubnano flags timestamps, anywhere in the packet, whose fractional
+// seconds go beyond nanoseconds. time.Parse would silently truncate them.
+func checkSubnano(packet map[string]any) []Issue {
+	var issues []Issue
+	walkStrings(packet, "", func(path, s string) {
+		m := fracSecondsRe.FindStringSubmatch(s)
+		if m == nil || len(m[1]) <= 9 {
+			return
+		}
+		issues = append(issues, Issue{Code: "TIME_PRECISION_EXCEEDED", Message: fmt.Sprintf("%s has %d fractional second digits; at most 9 (nanoseconds) are supported", s, len(m[1])), Path: path})
+	})
+	return issues
+}
+
+// checkWhitespace warns about every string value, anywhere in the packet,
+// that --trim-strings would change.
+func checkWhitespace(packet map[string]any) []Issue {
+	var issues []Issue
+	walkStrings(packet, "", func(path, s string) {
+		if strings.TrimSpace(s) != s {
+			issues = append(issues, Issue{Code: "STRING_WHITESPACE", Message: fmt.Sprintf("%q has leading or trailing whitespace", s), Path: path, Severity: severityWarning})
+		}
+	})
+	return issues
+}
+
+// checkConsistentTZ compares how created_at and expires_at spell their offset
+// ("Z", "+00:00", "+02:00"), not the instants they denote. Unparseable values
+// are left to checkTime.
+func checkConsistentTZ(packet map[string]any) []Issue {
+	created, _ := packet["created_at"].(string)
+	expires, _ := packet["expires_at"].(string)
+	createdTZ := tzSuffixRe.FindString(created)
+	expiresTZ := tzSuffixRe.FindString(expires)
+	if createdTZ == "" || expiresTZ == "" || createdTZ == expiresTZ {
+		return nil
+	}
+	return []Issue{{
+		Code:    "TIME_TZ_INCONSISTENT",
+		Message: fmt.Sprintf("expires_at uses offset %q but created_at uses %q", expiresTZ, createdTZ),
+		Path:    "/expires_at",
+	}}
+}
+
+func parseEpochCheck(expr string) (time.Duration, error) {
+	key, val, _ := strings.Cut(strings.TrimSpace(expr), "=")
+	if key != "interval" || val == "" {
+		return 0, fmt.Errorf("%q must be interval=DURATION", expr)
+	}
+	return parseDuration(val, "interval")
+}
+
+// checkEpoch requires created_at to lie on the producer's declared grid,
+// epoch_start + generation * interval, as an instant. Packets that declare no
+// epoch are not checked, and an unparseable created_at is left to checkTime.
+func checkEpoch(packet map[string]any, interval time.Duration) []Issue {
+	genVal, hasGen := packet["generation"]
+	startVal, hasStart := packet["epoch_start"]
+	if !hasGen && !hasStart {
+		return nil
+	}
+	gen, ok := genVal.(float64)
+	if !hasGen || !ok || gen < 0 || gen != math.Trunc(gen) {
+		return []Issue{{Code: "EPOCH_MISALIGNED", Message: "generation must be a non-negative integer alongside epoch_start", Path: "/generation"}}
+	}
+	startStr, _ := startVal.(string)
+	start, err := time.Parse(time.RFC3339Nano, startStr)
+	if err != nil {
+		return []Issue{{Code: "EPOCH_MISALIGNED", Message: "epoch_start must be an RFC3339 timestamp alongside generation", Path: "/epoch_start"}}
+	}
+	createdStr, _ := packet["created_at"].(string)
+	created, err := time.Parse(time.RFC3339Nano, createdStr)
+	if err != nil {
+		return nil
+	}
+	if gen > float64(math.MaxInt64/int64(interval)) {
+		return []Issue{{Code: "EPOCH_MISALIGNED", Message: fmt.Sprintf("generation %.0f * %s is out of range", gen, formatTTL(interval)), Path: "/generation"}}
+	}
+	expected := start.Add(time.Duration(gen) * interval)
+	if !created.Equal(expected) {
+		return []Issue{{
+			Code:    "EPOCH_MISALIGNED",
+			Message: fmt.Sprintf("created_at is %s but epoch_start + %d * %s is %s", created.UTC().Format(time.RFC3339Nano), int64(gen), formatTTL(interval), expected.UTC().Format(time.RFC3339Nano)),
+			Path:    "/created_at",
+		}}
+	}
+	return nil
+}
+
+// schemaIssues flattens a validation error tree into one issue per failing
+// leaf, located by the JSON pointer of the offending instance.
+func schemaIssues(err error) []Issue {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []Issue{{Code: "SCHEMA_VIOLATION", Message: err.Error()}}
+	}
+	var issues []Issue
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			issues = append(issues, Issue{Code: "SCHEMA_VIOLATION", Message: e.Message, Path: e.InstanceLocation})
+			return
+		}
+		for _, c := range e.Causes {
+			walk(c)
+		}
+	}
+	walk(ve)
+	return issues
+}
+
+// firstError drops everything after the first error, keeping any warnings
+// reported before it.
+func firstError(issues []Issue) []Issue {
+	for i, is := range issues {
+		if is.Severity == "" {
+			return issues[:i+1]
+		}
+	}
+	return issues
+}
+
+// truncateIssues keeps the first max issues and appends a TRUNCATED marker
+// counting the rest. Callers must decide validity before truncating.
+func truncateIssues(issues []Issue, max int) []Issue {
+	if max <= 0 || len(issues) <= max {
+		return issues
+	}
+	dropped := len(issues) - max
+	return append(issues[:max:max], Issue{
+		Code:     "TRUNCATED",
+		Message:  fmt.Sprintf("%d more issues", dropped),
+		Severity: severityInfo,
+	})
+}
+
+func sortIssues(issues []Issue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if a.Code != b.Code {
+			return a.Code < b.Code
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Message < b.Message
+	})
+}
+
+// NonceStore remembers packet identifiers until they expire. Implementations
+// must be safe for concurrent use; the in-memory store is the only one built
+// in, but a shared backend such as Redis can satisfy the same interface.
+type NonceStore interface {
+	// Record stores nonce until expires and reports whether it was new. A
+	// nonce already stored and not yet expired is not new.
+	Record(nonce string, expires, now time.Time) (bool, error)
+}
+
+// errNonceStoreFull is returned by memoryNonceStore when every entry it holds
+// is still live. Evicting one would let its packet be replayed, so the new
+// packet is refused instead.
+var errNonceStoreFull = errors.New("replay cache is full of unexpired identifiers")
+
+// memoryNonceStore is a bounded in-process NonceStore. Only expired entries
+// are evicted; once it is full of live ones, Record fails with
+// errNonceStoreFull until the earliest of them expires.
+type memoryNonceStore struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*nonceEntry
+	byExp   nonceHeap
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+	index   int
+}
+
+type nonceHeap []*nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h nonceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *nonceHeap) Push(x any) {
+	e := x.(*nonceEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *nonceHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newMemoryNonceStore(max int) *memoryNonceStore {
+	return &memoryNonceStore{max: max, entries: map[string]*nonceEntry{}}
+}
+
+func (m *memoryNonceStore) Record(nonce string, expires, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.byExp) > 0 && !m.byExp[0].expires.After(now) {
+		delete(m.entries, heap.Pop(&m.byExp).(*nonceEntry).nonce)
+	}
+	if _, ok := m.entries[nonce]; ok {
+		return false, nil
+	}
+	if len(m.byExp) >= m.max {
+		verbose.Printf("replay: cache full, refusing %s until %s", nonce, m.byExp[0].expires.Format(time.RFC3339))
+		return false, errNonceStoreFull
+	}
+	e := &nonceEntry{nonce: nonce, expires: expires}
+	heap.Push(&m.byExp, e)
+	m.entries[nonce] = e
+	return true, nil
+}
+
+// checkReplay records the packet's identifier, which stays reserved until
+// expires_at plus the clock skew, the last moment the packet would still be
+// accepted. A full or failing store is a tooling error so that replays fail
+// closed.
+func (v *validator) checkReplay(packet map[string]any, now time.Time) (*Issue, bool) {
+	val, ok := lookupField(packet, v.replayField)
+	nonce, isString := val.(string)
+	if !ok || !isString || nonce == "" {
+		return &Issue{Code: "REPLAY_NONCE_MISSING", Message: fmt.Sprintf("%s must be a non-empty string (required by --replay-protect)", v.replayField), Path: fieldPointer(v.replayField)}, false
+	}
+	s, _ := packet["expires_at"].(string)
+	expires, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, false // already reported by checkTime
+	}
+	fresh, err := v.replay.Record(nonce, expires.Add(v.expirySkew), now)
+	if errors.Is(err, errNonceStoreFull) {
+		return &Issue{Code: "REPLAY_CACHE_FULL", Message: fmt.Sprintf("cannot record %s %q: %v", v.replayField, nonce, err), Path: fieldPointer(v.replayField)}, true
+	}
+	if err != nil {
+		return &Issue{Code: "REPLAY_CACHE_ERROR", Message: err.Error()}, true
+	}
+	if !fresh {
+		return &Issue{Code: "REPLAY_DETECTED", Message: fmt.Sprintf("%s %q was already accepted", v.replayField, nonce), Path: fieldPointer(v.replayField)}, false
+	}
+	return nil, false
+}
+
+// server validates packets posted over HTTP. The validator and its compiled
+// schemas are shared by every request.
+type server struct {
+	v            *validator
+	now          func() time.Time
+	inflight     chan struct{} // nil when concurrency is unlimited
+	queueTimeout time.Duration
+	maxBody      int64
+	kinds        map[string]namedSchema // selected by packetKindHeader
+	audit        *auditLog              // nil unless --audit-log
+}
+
+// packetKindHeader names the --schemas entry a request is validated against.
+// Requests without it use the validator's usual schema selection.
+const packetKindHeader = "X-Packet-Kind"
+
+func newServer(v *validator, now func() time.Time, maxInflight int, queueTimeout time.Duration, maxBody int64) *server {
+	s := &server{v: v, now: now, queueTimeout: queueTimeout, maxBody: maxBody}
+	if maxInflight > 0 {
+		s.inflight = make(chan struct{}, maxInflight)
+	}
+	return s
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", s.handleValidate)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	return mux
+}
+
+// acquire takes an inflight slot, waiting up to queueTimeout for one to free.
+func (s *server) acquire(ctx context.Context) bool {
+	if s.inflight == nil {
+		return true
+	}
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	default:
+	}
+	if s.queueTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case s.inflight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *server) release() {
+	if s.inflight != nil {
+		<-s.inflight
+	}
+}
+
+func (s *server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.respond(w, r, http.StatusMethodNotAllowed, toolingFailure("METHOD_NOT_ALLOWED", "use POST"))
+		return
+	}
+	if !s.acquire(r.Context()) {
+		w.Header().Set("Retry-After", "1")
+		s.respond(w, r, http.StatusTooManyRequests, toolingFailure("SERVER_BUSY", "too many validations in flight"))
+		return
+	}
+	defer s.release()
+
+	data, err := readLimited(r.Body, s.maxBody)
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *sizeLimitError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		s.respond(w, r, status, toolingFailure("PACKET_READ_ERROR", err))
+		return
+	}
+
+	candidates := s.v.candidates
+	if kind := r.Header.Get(packetKindHeader); kind != "" {
+		schema, ok := s.kinds[kind]
+		if !ok {
+			s.respond(w, r, http.StatusBadRequest, toolingFailure("SCHEMA_KIND_UNKNOWN", fmt.Sprintf("no schema is configured for %s %q", packetKindHeader, kind)))
+			return
+		}
+		candidates = []namedSchema{schema}
+	}
+
+	res := s.v.validateWith(data, s.now(), candidates)
+	status := http.StatusOK
+	switch {
+	case res.tooling && hasCode(res.Issues, "PACKET_PARSE_ERROR"):
+		status = http.StatusBadRequest
+	case res.tooling:
+		status = http.StatusInternalServerError
+	case !res.OK:
+		status = http.StatusUnprocessableEntity
+	}
+	s.respond(w, r, status, res)
+}
+
+// handleHealth answers liveness and readiness probes. The server is healthy
+// once it is accepting connections and has a schema to validate against:
+// candidates compiled at startup, or schemas in schemasDir that all compile.
+// Those are compiled here if no packet has needed them yet, and cached by
+// schemaFor as usual.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeHTTPResult(w, http.StatusMethodNotAllowed, toolingFailure("METHOD_NOT_ALLOWED", "use GET"))
+		return
+	}
+	if len(s.v.candidates) == 0 {
+		found, err := filepath.Glob(filepath.Join(s.v.schemasDir, "context_packet.schema.v*.json"))
+		if err != nil || len(found) == 0 {
+			writeHTTPResult(w, http.StatusServiceUnavailable, toolingFailure("SCHEMA_UNAVAILABLE", fmt.Sprintf("no schemas found in %s", s.v.schemasDir)))
+			return
+		}
+		for _, path := range found {
+			sv := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "context_packet.schema.v"), ".json")
+			if _, code, err := s.v.schemaFor(sv); err != nil {
+				writeHTTPResult(w, http.StatusServiceUnavailable, toolingFailure(code, err))
+				return
+			}
+		}
+	}
+	writeHTTPResult(w, http.StatusOK, Result{OK: true, Issues: []Issue{}})
+}
+
+// respond writes res, first recording it in the audit log. A request whose
+// outcome cannot be recorded is answered with 500 instead.
+func (s *server) respond(w http.ResponseWriter, r *http.Request, status int, res Result) {
+	if s.audit != nil {
+		if err := s.audit.record(s.now(), r.RemoteAddr, res); err != nil {
+			writeHTTPResult(w, http.StatusInternalServerError, toolingFailure("AUDIT_WRITE_ERROR", err))
+			return
+		}
+	}
+	writeHTTPResult(w, status, res)
+}
+
+func writeHTTPResult(w http.ResponseWriter, status int, res Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeReport(w, res)
+}
+
+// validatorProto is the gRPC API as a descriptor in text form, so the service
+// needs no generated code. The packet travels as JSON bytes rather than as a
+// protobuf message, so schema changes never touch the API:
+//
+//	message PacketRequest { bytes packet = 1; string kind = 2; }
+//	message Issue { string code = 1; string message = 2; string path = 3; string severity = 4; }
+//	message ValidationResponse {
+//	  bool ok = 1; string schema_version = 2; string schema = 3;
+//	  string schema_id = 4; repeated Issue issues = 5;
+//	}
+//	service Validator { rpc Validate(PacketRequest) returns (ValidationResponse); }
+const validatorProto = `
+name: "contextbroker/v1/validator.proto"
+package: "contextbroker.v1"
+syntax: "proto3"
+message_type {
+  name: "PacketRequest"
+  field { name: "packet" json_name: "packet" number: 1 label: LABEL_OPTIONAL type: TYPE_BYTES }
+  field { name: "kind" json_name: "kind" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+message_type {
+  name: "Issue"
+  field { name: "code" json_name: "code" number: 1 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "message" json_name: "message" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "path" json_name: "path" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "severity" json_name: "severity" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING }
+}
+message_type {
+  name: "ValidationResponse"
+  field { name: "ok" json_name: "ok" number: 1 label: LABEL_OPTIONAL type: TYPE_BOOL }
+  field { name: "schema_version" json_name: "schemaVersion" number: 2 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "schema" json_name: "schema" number: 3 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "schema_id" json_name: "schemaId" number: 4 label: LABEL_OPTIONAL type: TYPE_STRING }
+  field { name: "issues" json_name: "issues" number: 5 label: LABEL_REPEATED type: TYPE_MESSAGE type_name: ".contextbroker.v1.Issue" }
+}
+service {
+  name: "Validator"
+  method { name: "Validate" input_type: ".contextbroker.v1.PacketRequest" output_type: ".contextbroker.v1.ValidationResponse" }
+}
+`
+
+// validatorFile is registered globally so that server reflection can
+// describe the service to clients such as grpcurl.
+var validatorFile = mustRegisterFile(validatorProto)
+
+func mustRegisterFile(text string) protoreflect.FileDescriptor {
+	var fdp descriptorpb.FileDescriptorProto
+	if err := prototext.Unmarshal([]byte(text), &fdp); err != nil {
+		panic(err)
+	}
+	fd, err := protodesc.NewFile(&fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	if err := protoregistry.GlobalFiles.RegisterFile(fd); err != nil {
+		panic(err)
+	}
+	return fd
+}
+
+var validatorService = grpc.ServiceDesc{
+	ServiceName: "contextbroker.v1.Validator",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Validate",
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			in := dynamicpb.NewMessage(validatorFile.Messages().ByName("PacketRequest"))
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handle := func(ctx context.Context, req any) (any, error) {
+				return srv.(*server).validateRPC(ctx, req.(*dynamicpb.Message))
+			}
+			if interceptor == nil {
+				return handle(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/contextbroker.v1.Validator/Validate"}, handle)
+		},
+	}},
+	Metadata: validatorFile.Path(),
+}
+
+// grpcServer serves validatorService from the same validator, inflight slots,
+// and audit log as the HTTP routes.
+func (s *server) grpcServer() *grpc.Server {
+	// Leave room for the request envelope around a packet of maxBody bytes;
+	// validateRPC enforces the packet limit itself.
+	gs := grpc.NewServer(grpc.MaxRecvMsgSize(int(s.maxBody) + 1024))
+	gs.RegisterService(&validatorService, s)
+	reflection.Register(gs)
+	return gs
+}
+
+// validateRPC mirrors handleValidate. Packets that fail validation or do not
+// parse are answered normally, with the issues in the response; errors are
+// reserved for requests that were not validated.
+func (s *server) validateRPC(ctx context.Context, req *dynamicpb.Message) (*dynamicpb.Message, error) {
+	if !s.acquire(ctx) {
+		return s.rpcRespond(ctx, codes.ResourceExhausted, toolingFailure("SERVER_BUSY", "too many validations in flight"))
+	}
+	defer s.release()
+
+	fields := req.Descriptor().Fields()
+	data := req.Get(fields.ByName("packet")).Bytes()
+	if int64(len(data)) > s.maxBody {
+		return s.rpcRespond(ctx, codes.ResourceExhausted, toolingFailure("PACKET_READ_ERROR", &sizeLimitError{limit: s.maxBody}))
+	}
+
+	candidates := s.v.candidates
+	if kind := req.Get(fields.ByName("kind")).String(); kind != "" {
+		schema, ok := s.kinds[kind]
+		if !ok {
+			return s.rpcRespond(ctx, codes.InvalidArgument, toolingFailure("SCHEMA_KIND_UNKNOWN", fmt.Sprintf("no schema is configured for kind %q", kind)))
+		}
+		candidates = []namedSchema{schema}
+	}
+
+	res := s.v.validateWith(data, s.now(), candidates)
+	code := codes.OK
+	if res.tooling && !hasCode(res.Issues, "PACKET_PARSE_ERROR") {
+		code = codes.Internal
+	}
+	return s.rpcRespond(ctx, code, res)
+}
+
+// rpcRespond is respond for gRPC: it records res in the audit log, then
+// returns it as a ValidationResponse, or as a status error naming its first
+// error when code is not OK. Warnings such as SCHEMA_SKIPPED can come first
+// and are passed over.
+func (s *server) rpcRespond(ctx context.Context, code codes.Code, res Result) (*dynamicpb.Message, error) {
+	if s.audit != nil {
+		addr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		if err := s.audit.record(s.now(), addr, res); err != nil {
+			return nil, status.Errorf(codes.Internal, "AUDIT_WRITE_ERROR: %v", err)
+		}
+	}
+	if code != codes.OK {
+		is := res.Issues[0]
+		for _, e := range res.Issues {
+			if e.Severity == "" {
+				is = e
+				break
+			}
+		}
+		return nil, status.Errorf(code, "%s: %s", is.Code, is.Message)
+	}
+	return validationResponse(res), nil
+}
+
+func validationResponse(res Result) *dynamicpb.Message {
+	msgs := validatorFile.Messages()
+	resp := dynamicpb.NewMessage(msgs.ByName("ValidationResponse"))
+	set := func(m *dynamicpb.Message, name string, v protoreflect.Value) {
+		m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(name)), v)
+	}
+	set(resp, "ok", protoreflect.ValueOfBool(res.OK))
+	set(resp, "schema_version", protoreflect.ValueOfString(res.SchemaVersion))
+	set(resp, "schema", protoreflect.ValueOfString(res.Schema))
+	set(resp, "schema_id", protoreflect.ValueOfString(res.SchemaID))
+	issues := resp.Mutable(msgs.ByName("ValidationResponse").Fields().ByName("issues")).List()
+	for _, is := range res.Issues {
+		m := dynamicpb.NewMessage(msgs.ByName("Issue"))
+		set(m, "code", protoreflect.ValueOfString(is.Code))
+		set(m, "message", protoreflect.ValueOfString(is.Message))
+		set(m, "path", protoreflect.ValueOfString(is.Path))
+		set(m, "severity", protoreflect.ValueOfString(is.Severity))
+		issues.Append(protoreflect.ValueOfMessage(m))
+	}
+	return resp
+}
+
+func compileSchemaFile(schemaPath string) (*jsonschema.Schema, string, error) {
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, "SCHEMA_LOAD_ERROR", err
+	}
+	return compileSchema(schemaPath, data, "SCHEMA_LOAD_ERROR")
+}
+
+// compileInlineSchema compiles a schema held in memory. There is no load step
+// for an inline schema, so malformed JSON is reported as a compile error.
+func compileInlineSchema(src string) (*jsonschema.Schema, error) {
+	schema, _, err := compileSchema("--schema-inline", []byte(src), "SCHEMA_COMPILE_ERROR")
+	return schema, err
+}
+
+// compileSchema returns the issue code for the failing stage along with any
+// error; parseCode is used when the document is not valid JSON. Errors are
+// *schemaError, located in the document called name.
+func compileSchema(name string, data []byte, parseCode string) (*jsonschema.Schema, string, error) {
+	// Parsed here first because the compiler's own parse error carries
+	// neither the file nor the offset.
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		se := &schemaError{file: name, err: err}
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			se.line, se.col = lineCol(data, syntax.Offset)
+		}
+		return nil, parseCode, se
+	}
+
+	schemaCompiler := jsonschema.NewCompiler()
+	schemaCompiler.ExtractAnnotations = true
+	if err := schemaCompiler.AddResource("schema.json", bytes.NewReader(data)); err != nil {
+		return nil, parseCode, &schemaError{file: name, err: err}
+	}
+
+	schema, err := schemaCompiler.Compile("schema.json")
+	if err != nil {
+		return nil, "SCHEMA_COMPILE_ERROR", &schemaError{file: name, err: err}
+	}
+	return schema, "", nil
+}
+
+// schemaError locates a schema that failed to load or compile: by line and
+// column for malformed JSON, and by JSON pointer within the schema for each
+// keyword that the meta-schema rejects.
+type schemaError struct {
+	file      string
+	line, col int // 0 unless the JSON is malformed
+	err       error
+}
+
+func (e *schemaError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %v", e.file, e.line, e.col, e.err)
+	}
+	msgs := make([]string, 0, 1)
+	for _, is := range e.issues("") {
+		msgs = append(msgs, is.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *schemaError) Unwrap() error { return e.err }
+
+// issues reports e as one issue per failing schema location, each with its
+// pointer as Path.
+func (e *schemaError) issues(code string) []Issue {
+	var ve *jsonschema.ValidationError
+	if e.line > 0 || !errors.As(e.err, &ve) {
+		msg := e.err.Error()
+		var se *jsonschema.SchemaError
+		if errors.As(e.err, &se) && se.Err != nil {
+			// Drop the compiler's name for the document, which is not the file.
+			msg = se.Err.Error()
+			if base, _, _ := strings.Cut(se.SchemaURL, "#"); strings.HasPrefix(base, "file://") && strings.HasSuffix(base, "/schema.json") {
+				msg = strings.ReplaceAll(msg, base, "")
+			}
+		}
+		if e.line == 0 {
+			msg = e.file + ": " + strings.TrimPrefix(msg, "jsonschema: ")
+		} else {
+			msg = e.Error()
+		}
+		return []Issue{{Code: code, Message: msg}}
+	}
+	issues := schemaIssues(ve)
+	for i := range issues {
+		issues[i].Code = code
+		at := issues[i].Path
+		if at == "" {
+			at = "the root"
+		}
+		issues[i].Message = fmt.Sprintf("%s at %s: %s", e.file, at, issues[i].Message)
+	}
+	return issues
+}
+
+// lineCol gives the 1-based line and column of the byte at which a
+// json.SyntaxError stopped; its Offset counts that byte as read.
+func lineCol(data []byte, offset int64) (line, col int) {
+	offset--
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// compileSchemaBundle compiles the root entry of a bundle file. Every entry is
+// registered as bundle:///<name>, so a "$ref": "child" in one entry resolves
+// to its sibling named child.
+func compileSchemaBundle(path, root string) (*jsonschema.Schema, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "SCHEMA_LOAD_ERROR", err
+	}
+	var bundle struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		se := &schemaError{file: path, err: err}
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			se.line, se.col = lineCol(data, syntax.Offset)
+		}
+		return nil, "SCHEMA_LOAD_ERROR", se
+	}
+	if _, ok := bundle.Schemas[root]; !ok {
+		return nil, "SCHEMA_COMPILE_ERROR", fmt.Errorf("schema bundle %s has no entry %q", path, root)
+	}
+
+	schemaCompiler := jsonschema.NewCompiler()
+	schemaCompiler.ExtractAnnotations = true
+	for _, name := range sortedKeys(bundle.Schemas) {
+		if err := schemaCompiler.AddResource("bundle:///"+name, bytes.NewReader(bundle.Schemas[name])); err != nil {
+			return nil, "SCHEMA_COMPILE_ERROR", fmt.Errorf("schema bundle entry %q: %v", name, err)
+		}
+	}
+	schema, err := schemaCompiler.Compile("bundle:///" + root)
+	if err != nil {
+		// Not located by pointer: the compiler does not say which entry failed.
+		return nil, "SCHEMA_COMPILE_ERROR", fmt.Errorf("%s: %v", path, err)
+	}
+	return schema, "", nil
+}
+
+func readPacketFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPacket(f)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// fetchPacket downloads a packet under the same size limit as a file read.
+// Any non-2xx response is an error carrying the status.
+func fetchPacket(url string, headers http.Header, timeout time.Duration, retries int) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := doRetrying(client, retries, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err == nil {
+			req.Header = headers.Clone()
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return readPacket(resp.Body)
+}
+
+// retryBackoff is the wait before the first retry; it doubles for each one
+// after that.
+var retryBackoff = 200 * time.Millisecond
+
+// doRetrying sends a request built by newReq, and sends a fresh one up to
+// retries more times while the attempt fails with a network error, 429, or
+// 5xx. The last response or error is returned.
+func doRetrying(client *http.Client, retries int, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if attempt == retries || (err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		verbose.Printf("fetch: retrying %s %s after attempt %d", req.Method, req.URL, attempt+1)
+		time.Sleep(retryBackoff << attempt)
+	}
+}
+
+// policyClient asks an OPA-style policy decision service about each packet.
+type policyClient struct {
+	url     string
+	client  *http.Client
+	retries int
+}
+
+// decide POSTs {"input": packet} and reads the decision from the response's
+// result: either a boolean, or an object with an allow boolean and an optional
+// reason string or reasons list, as OPA's data API returns them. An undefined
+// result is an error, so a missing rule fails closed.
+func (p *policyClient) decide(packet map[string]any) (allow bool, reason string, err error) {
+	body, err := json.Marshal(map[string]any{"input": packet})
+	if err != nil {
+		return false, "", err
+	}
+	resp, err := doRetrying(p.client, p.retries, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, "", fmt.Errorf("POST %s: %s", p.url, resp.Status)
+	}
+	data, err := readLimited(resp.Body, maxPacketBytes)
+	if err != nil {
+		return false, "", err
+	}
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(data, &decision); err != nil {
+		return false, "", fmt.Errorf("invalid policy decision: %v", err)
+	}
+	if decision.Result == nil {
+		return false, "", errors.New("policy decision is undefined (no result)")
+	}
+	if err := json.Unmarshal(decision.Result, &allow); err == nil {
+		return allow, "", nil
+	}
+	var obj struct {
+		Allow   *bool    `json:"allow"`
+		Reason  string   `json:"reason"`
+		Reasons []string `json:"reasons"`
+	}
+	if err := json.Unmarshal(decision.Result, &obj); err != nil || obj.Allow == nil {
+		return false, "", errors.New("policy result must be a boolean or an object with an allow boolean")
+	}
+	reasons := obj.Reasons
+	if obj.Reason != "" {
+		reasons = append([]string{obj.Reason}, reasons...)
+	}
+	return *obj.Allow, strings.Join(reasons, "; "), nil
+}
+
+// checkPolicy applies --policy-url. A service that cannot be reached or
+// answers without a decision is a tooling error, so the check fails closed.
+func (v *validator) checkPolicy(packet map[string]any) (*Issue, bool) {
+	allow, reason, err := v.policy.decide(packet)
+	if err != nil {
+		return &Issue{Code: "POLICY_UNAVAILABLE", Message: err.Error()}, true
+	}
+	if allow {
+		return nil, false
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return &Issue{Code: "POLICY_DENIED", Message: "denied by policy: " + reason}, false
+}
+
+func readPacket(r io.Reader) ([]byte, error) {
+	return readLimited(r, maxPacketBytes)
+}
+
+// packetBufs holds read buffers for the batch modes, which would otherwise
+// allocate a fresh buffer, grown in steps, for every file. Only the bytes are
+// reused. A json.Decoder cannot be: it has no Reset, and it reads ahead of
+// the value it returns, so one shared across files would need them joined
+// into a single stream, losing the per-file size limit and error scope. The
+// stdin array and object-map modes already decode through one Decoder. The
+// decoded packet itself always gets fresh maps, because a Result keeps it
+// after the visitor returns.
+var packetBufs = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// readPacketPooled is readPacket into a buffer from packetBufs. The caller
+// returns it with releasePacket once nothing refers to its bytes any more.
+func readPacketPooled(r io.Reader) (*bytes.Buffer, error) {
+	buf := packetBufs.Get().(*bytes.Buffer)
+	buf.Reset()
+	if _, err := buf.ReadFrom(io.LimitReader(r, maxPacketBytes+1)); err != nil {
+		releasePacket(buf)
+		return nil, err
+	}
+	if buf.Len() > maxPacketBytes {
+		releasePacket(buf)
+		return nil, &sizeLimitError{limit: maxPacketBytes}
+	}
+	return buf, nil
+}
+
+func releasePacket(buf *bytes.Buffer) {
+	if buf != nil {
+		packetBufs.Put(buf)
+	}
+}
+
+// pooledBytes returns buf's contents, or nil for a failed read.
+func pooledBytes(buf *bytes.Buffer) []byte {
+	if buf == nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+type sizeLimitError struct {
+	limit int64
+}
+
+func (e *sizeLimitError) Error() string {
+	return fmt.Sprintf("packet exceeds maximum size (%d bytes)", e.limit)
+}
+
+// readLimited reads at most limit bytes, failing with *sizeLimitError rather
+// than buffering an oversized input.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &sizeLimitError{limit: limit}
+	}
+	return data, nil
+}
+
+// checkLinks treats each packet's parent_id as an edge to the packet with that
+// context_id and reports, as batch-level issues, parents missing from the
+// batch and cycles. Packets that fail validation still take part as long as
+// they decode; those without a context_id, or repeating an earlier one, do
+// not.
+func checkLinks(results []Result) []Issue {
+	var order []string
+	name := map[string]string{}
+	parent := map[string]string{}
+	for _, r := range results {
+		id, ok := r.packet["context_id"].(string)
+		if _, dup := name[id]; !ok || dup {
+			continue
+		}
+		order = append(order, id)
+		name[id] = r.Packet
+		if p, ok := r.packet["parent_id"].(string); ok {
+			parent[id] = p
+		}
+	}
+
+	var issues []Issue
+	for _, id := range order {
+		if p, ok := parent[id]; ok {
+			if _, found := name[p]; !found {
+				issues = append(issues, Issue{Code: "LINK_DANGLING", Message: fmt.Sprintf("%s: parent_id %s of %s is not the context_id of any packet in the batch", name[id], p, id)})
+			}
+		}
+	}
+
+	// Each packet has at most one parent, so following parent links from
+	// every packet in turn finds each cycle exactly once.
+	const onPath, done = 1, 2
+	state := map[string]int{}
+	for _, start := range order {
+		var path []string
+		id := start
+		for {
+			if _, found := name[id]; !found || state[id] == done {
+				break
+			}
+			if state[id] == onPath {
+				for i, n := range path {
+					if n == id {
+						cycle := append(path[i:len(path):len(path)], id)
+						issues = append(issues, Issue{Code: "LINK_CYCLE", Message: "parent_id links form a cycle: " + strings.Join(cycle, " -> ")})
+						break
+					}
+				}
+				break
+			}
+			state[id] = onPath
+			path = append(path, id)
+			p, ok := parent[id]
+			if !ok {
+				break
+			}
+			id = p
+		}
+		for _, n := range path {
+			state[n] = done
+		}
+	}
+	return issues
+}
+
+// collectionParseError reports input to eachArrayPacket or eachObjectPacket
+// that is not the expected JSON array or object.
+type collectionParseError struct {
+	what string
+	err  error
+}
+
+func (e *collectionParseError) Error() string {
+	return "invalid " + e.what + ": " + e.err.Error()
+}
+
+// eachArrayPacket decodes a JSON array of packets one element at a time and
+// passes each to fn as stdin[i], so a large array is never held in memory as
+// a whole. An element over maxPacketBytes is passed with a *sizeLimitError.
+// Iteration stops early when fn returns false. With a positive limit, it also
+// stops after that many elements, and capped reports whether any were left
+// unread. As with eachTarPacket, data is reused once fn returns.
+func eachArrayPacket(r io.Reader, limit int, fn func(name string, data []byte, err error) bool) (capped bool, err error) {
+	const what = "packet array on stdin"
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return false, &collectionParseError{what, err}
+	} else if tok != json.Delim('[') {
+		return false, &collectionParseError{what, fmt.Errorf("expected an array, found %v", tok)}
+	}
+	var elem json.RawMessage // Decode appends into its existing capacity
+	for i := 0; dec.More(); i++ {
+		if limit > 0 && i == limit {
+			return true, nil
+		}
+		if err := dec.Decode(&elem); err != nil {
+			return false, &collectionParseError{what, err}
+		}
+		name := fmt.Sprintf("stdin[%d]", i)
+		data, err := []byte(elem), error(nil)
+		if len(elem) > maxPacketBytes {
+			data, err = nil, &sizeLimitError{limit: maxPacketBytes}
+		}
+		if !fn(name, data, err) {
+			return false, nil
+		}
+	}
+	return false, collectionEnd(dec, what)
+}
+
+// eachObjectPacket is eachArrayPacket for a JSON object whose values are
+// packets, passing each to fn under its key. A key seen twice is passed with
+// an error instead of its packet.
+func eachObjectPacket(r io.Reader, what string, limit int, fn func(name string, data []byte, err error) bool) (capped bool, err error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return false, &collectionParseError{what, err}
+	} else if tok != json.Delim('{') {
+		return false, &collectionParseError{what, fmt.Errorf("expected an object, found %v", tok)}
+	}
+	seen := map[string]bool{}
+	var elem json.RawMessage
+	for i := 0; dec.More(); i++ {
+		if limit > 0 && i == limit {
+			return true, nil
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return false, &collectionParseError{what, err}
+		}
+		key := tok.(string)
+		if err := dec.Decode(&elem); err != nil {
+			return false, &collectionParseError{what, err}
+		}
+		data := []byte(elem)
+		switch {
+		case seen[key]:
+			data, err = nil, fmt.Errorf("duplicate key %q", key)
+		case len(elem) > maxPacketBytes:
+			data, err = nil, &sizeLimitError{limit: maxPacketBytes}
+		}
+		seen[key] = true
+		if !fn(key, data, err) {
+			return false, nil
+		}
+	}
+	return false, collectionEnd(dec, what)
+}
+
+// collectionEnd consumes the closing delimiter and requires nothing to follow.
+func collectionEnd(dec *json.Decoder, what string) error {
+	if _, err := dec.Token(); err != nil {
+		return &collectionParseError{what, err}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return &collectionParseError{what, errors.New("unexpected data after the end")}
+	}
+	return nil
+}
+
+// checkMapKey cross-checks an --object-map key against the packet's own
+// identifier. A packet that failed to parse has nothing to compare.
+func checkMapKey(packet map[string]any, key, field string) []Issue {
+	if packet == nil {
+		return nil
+	}
+	id, ok := lookupField(packet, field)
+	if !ok {
+		return []Issue{{Code: "ID_KEY_MISMATCH", Message: fmt.Sprintf("%s is missing, but the packet is stored under key %q", field, key), Path: fieldPointer(field)}}
+	}
+	if id != key {
+		return []Issue{{Code: "ID_KEY_MISMATCH", Message: fmt.Sprintf("%s is %v, but the packet is stored under key %q", field, id, key), Path: fieldPointer(field)}}
+	}
+	return nil
+}
+
+// eachTarPacket streams the *.json members of a tar archive, gzip-compressed
+// or not, to fn one at a time without extracting them to disk. Iteration
+// stops early when fn returns false. Members modified before a non-zero since
+// are skipped unread and counted. With a positive limit, members after the
+// first limit packets are likewise counted in capped from their headers alone.
+// Read buffers are pooled, so fn must not keep data after it returns.
+func eachTarPacket(path string, since time.Time, limit int, fn func(name string, data []byte, err error) bool) (skipped, capped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for passed := 0; ; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return skipped, capped, nil
+		}
+		if err != nil {
+			return skipped, capped, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(strings.ToLower(hdr.Name), ".json") {
+			continue
+		}
+		if hdr.ModTime.Before(since) {
+			skipped++
+			continue
+		}
+		if limit > 0 && passed == limit {
+			capped++
+			continue
+		}
+		passed++
+		buf, err := readPacketPooled(tr)
+		more := fn(hdr.Name, pooledBytes(buf), err)
+		releasePacket(buf)
+		if !more {
+			return skipped, capped, nil
+		}
+	}
+}
+
+// eachDirPacket walks dir in lexical order and passes each *.json file, by
+// its slash-separated path relative to dir, to fn. Result files written by
+// --output-dir are not packets and are ignored. since, limit, and the return
+// values work as in eachTarPacket; files past the limit are counted without
+// being opened.
+func eachDirPacket(dir string, since time.Time, limit int, fn func(name string, data []byte, err error) bool) (skipped, capped int, err error) {
+	passed := 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(d.Name())
+		if !d.Type().IsRegular() || !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".result.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(since) {
+			skipped++
+			return nil
+		}
+		if limit > 0 && passed == limit {
+			capped++
+			return nil
+		}
+		passed++
+		f, err := os.Open(path)
+		var buf *bytes.Buffer
+		if err == nil {
+			buf, err = readPacketPooled(f)
+			f.Close()
+		}
+		more := fn(filepath.ToSlash(rel), pooledBytes(buf), err)
+		releasePacket(buf)
+		if !more {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return skipped, capped, err
+}
+
+func verifyIntegrity(packet map[string]any) error {
+	sigStr, hasSig := packet["signature"].(string)
+	pubStr, hasPub := packet["public_key_id"].(string)
+
+	if !hasSig && !hasPub {
+		return nil
+	}
+	if hasSig != hasPub {
+		return errors.New("both signature and public_key_id must be provided together or omitted")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+	pubBytes, err := base64.StdEncoding.DecodeString(pubStr)
+	if err != nil {
+		return fmt.Errorf("failed to decode public_key_id: %v", err)
+	}
+	if publicKeyType(pubBytes) == "RSA" {
+		return errors.New("public_key_id is an RSA key, but only Ed25519 signatures are verified")
+	}
+	if len(pubBytes) != ed25519.PublicKeySize {
+		return errors.New("invalid ed25519 public key size")
+	}
+
+	canonicalPacket := make(map[string]any)
+	for k, v := range packet {
+		if k != "signature" && k != "public_key_id" {
+			canonicalPacket[k] = v
+		}
+	}
+
+	canonicalBytes, err := canonicalJSON(canonicalPacket)
+	if err != nil {
+		return fmt.Errorf("failed to canonicalize packet: %v", err)
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(pubBytes), canonicalBytes, sigBytes) {
+		return errors.New("signature verification failed")
+	}
+
+	return nil
+}
+
+// algKeyTypes maps each signature alg whose key type is known, as folded by
+// normalizeAlgorithm, to the type of key it needs.
+var algKeyTypes = map[string]string{
+	"ED25519": "Ed25519", "EDDSA": "Ed25519",
+	"RS256": "RSA", "RS384": "RSA", "RS512": "RSA",
+	"PS256": "RSA", "PS384": "RSA", "PS512": "RSA",
+}
+
+// publicKeyType names the type of a decoded public_key_id: a raw Ed25519 key,
+// or an Ed25519 or RSA key in DER, as PKIX or PKCS #1. It returns "" for
+// anything else.
+func publicKeyType(der []byte) string {
+	if len(der) == ed25519.PublicKeySize {
+		return "Ed25519"
+	}
+	if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		switch key.(type) {
+		case ed25519.PublicKey:
+			return "Ed25519"
+		case *rsa.PublicKey:
+			return "RSA"
+		}
+		return ""
+	}
+	if _, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return "RSA"
+	}
+	return ""
+}
+
+// checkAlgKey fails a packet whose declared alg needs a different type of key
+// than public_key_id holds, before verification can fail less clearly. An
+// alg of unknown key type, or a key that cannot be decoded, is left to
+// verifyIntegrity.
+func checkAlgKey(packet map[string]any) []Issue {
+	alg, _ := packet["alg"].(string)
+	want := algKeyTypes[normalizeAlgorithm(alg)]
+	pubStr, _ := packet["public_key_id"].(string)
+	pub, err := base64.StdEncoding.DecodeString(pubStr)
+	if want == "" || err != nil {
+		return nil
+	}
+	if got := publicKeyType(pub); got != "" && got != want {
+		return []Issue{{Code: "SIGNATURE_ALG_KEY_MISMATCH", Message: fmt.Sprintf("alg %s needs an %s key, but public_key_id is an %s key", alg, want, got), Path: "/alg"}}
+	}
+	return nil
+}
+
+// signatureFields make up the signing convention's metadata; a packet carries
+// all of them or none.
+var signatureFields = []string{"signature", "signer_key_id", "signed_at"}
+
+// approvedAlgorithms are the FIPS-approved signature (FIPS 186-5) and hash
+// (FIPS 180-4, FIPS 202) algorithms, keyed by normalizeAlgorithm. The
+// validator itself only uses Ed25519 and SHA-256.
+var approvedAlgorithms = map[string]bool{
+	"ED25519": true, "EDDSA": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+	"RS256": true, "RS384": true, "RS512": true,
+	"SHA224": true, "SHA256": true, "SHA384": true, "SHA512": true,
+	"SHA3224": true, "SHA3256": true, "SHA3384": true, "SHA3512": true,
+}
+
+// normalizeAlgorithm folds spellings such as "sha-256" and "SHA_256" together.
+func normalizeAlgorithm(s string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToUpper(s))
+}
+
+// checkAlgorithms enforces --fips on the algorithms a packet declares in alg
+// (signature) and hash_alg. Packets that declare neither pass.
+func checkAlgorithms(packet map[string]any) []Issue {
+	var issues []Issue
+	for _, field := range []string{"alg", "hash_alg"} {
+		val, ok := packet[field]
+		if !ok {
+			continue
+		}
+		if s, ok := val.(string); !ok {
+			issues = append(issues, Issue{Code: "ALGORITHM_NOT_APPROVED", Message: fmt.Sprintf("%s must be a string naming an algorithm (required by --fips)", field), Path: "/" + field})
+		} else if !approvedAlgorithms[normalizeAlgorithm(s)] {
+			issues = append(issues, Issue{Code: "ALGORITHM_NOT_APPROVED", Message: fmt.Sprintf("%s %s is not a FIPS-approved algorithm", field, s), Path: "/" + field})
+		}
+	}
+	return issues
+}
+
+// checkSignatureFields reports packets that carry only part of the signature
+// metadata. It looks at presence only and never verifies the signature.
+func checkSignatureFields(packet map[string]any) []Issue {
+	var present, missing []string
+	for _, f := range signatureFields {
+		if _, ok := packet[f]; ok {
+			present = append(present, f)
+		} else {
+			missing = append(missing, f)
+		}
+	}
+	if len(present) == 0 || len(missing) == 0 {
+		return nil
+	}
+	return []Issue{{
+		Code:    "SIGNATURE_METADATA_INCOMPLETE",
+		Message: fmt.Sprintf("%s present but missing %s", strings.Join(present, ", "), strings.Join(missing, ", ")),
+		Path:    "/" + missing[0],
+	}}
+}
+
+// loadProducerList reads one producer_id per line, skipping blank lines and
+// # comments.
+func loadProducerList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			ids = append(ids, line)
+		}
+	}
+	return ids, nil
+}
+
+// checkProducer is an allowlist on producer_id. It does not authenticate the
+// producer; pair it with signature verification for that.
+func checkProducer(packet map[string]any, trusted map[string]bool) []Issue {
+	val, ok := packet["producer_id"]
+	if !ok {
+		return []Issue{{Code: "PRODUCER_MISSING", Message: "producer_id is required by the trusted producer policy", Path: "/producer_id"}}
+	}
+	id, ok := val.(string)
+	if !ok {
+		return []Issue{{Code: "PRODUCER_UNTRUSTED", Message: "producer_id must be a string", Path: "/producer_id"}}
+	}
+	if !trusted[id] {
+		return []Issue{{Code: "PRODUCER_UNTRUSTED", Message: fmt.Sprintf("producer_id %q is not a trusted producer", id), Path: "/producer_id"}}
+	}
+	return nil
+}
+
+// checkContentLength compares content_length with the length of payload in
+// canonical form, so producers must serialize it with canonicalJSON's rules.
+func checkContentLength(packet map[string]any) []Issue {
+	payload, ok := packet["payload"]
+	if !ok {
+		return []Issue{{Code: "CONTENT_LENGTH_MISMATCH", Message: "payload is missing (required by --check-content-length)", Path: "/payload"}}
+	}
+	declared, ok := packet["content_length"].(float64)
+	if !ok || declared < 0 || declared != math.Trunc(declared) {
+		return []Issue{{Code: "CONTENT_LENGTH_MISMATCH", Message: "content_length must be a non-negative integer", Path: "/content_length"}}
+	}
+	b, err := canonicalJSON(payload)
+	if err != nil {
+		return []Issue{{Code: "CONTENT_LENGTH_MISMATCH", Message: fmt.Sprintf("failed to canonicalize payload: %v", err), Path: "/payload"}}
+	}
+	if declared != float64(len(b)) {
+		return []Issue{{Code: "CONTENT_LENGTH_MISMATCH", Message: fmt.Sprintf("content_length is %.0f but the canonical payload is %d bytes", declared, len(b)), Path: "/content_length"}}
+	}
+	return nil
+}
+
+// contentTypeKinds maps the media types --check-content-type knows to the
+// JSON kinds their payload may take. Binary payloads travel base64-encoded.
+var contentTypeKinds = map[string][]string{
+	"application/json":         {"object", "array"},
+	"application/octet-stream": {"string"},
+	"text/plain":               {"string"},
+	"text/markdown":            {"string"},
+	"text/html":                {"string"},
+	"text/csv":                 {"string"},
+}
+
+// checkContentType compares the payload's JSON kind with what content_type
+// allows. Parameters such as charset are ignored, and any +json type counts
+// as application/json. A packet without content_type passes; an unknown type
+// only warns.
+func checkContentType(packet map[string]any) []Issue {
+	raw, ok := packet["content_type"]
+	if !ok {
+		return nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return []Issue{{Code: "CONTENT_TYPE_MISMATCH", Message: "content_type must be a string", Path: "/content_type"}}
+	}
+	mediaType, _, err := mime.ParseMediaType(s)
+	if err != nil {
+		return []Issue{{Code: "CONTENT_TYPE_MISMATCH", Message: fmt.Sprintf("content_type %q is not a media type: %v", s, err), Path: "/content_type"}}
+	}
+	if strings.HasSuffix(mediaType, "+json") {
+		mediaType = "application/json"
+	}
+	kinds, known := contentTypeKinds[mediaType]
+	if !known {
+		return []Issue{{Code: "CONTENT_TYPE_UNKNOWN", Message: fmt.Sprintf("content_type %s is not known to --check-content-type; payload not checked", mediaType), Path: "/content_type", Severity: severityWarning}}
+	}
+	payload, ok := packet["payload"]
+	if !ok {
+		return []Issue{{Code: "CONTENT_TYPE_MISMATCH", Message: "payload is missing (required by --check-content-type)", Path: "/payload"}}
+	}
+	if kind := jsonKind(payload); !containsString(kinds, kind) {
+		return []Issue{{Code: "CONTENT_TYPE_MISMATCH", Message: fmt.Sprintf("content_type %s requires a payload of type %s, got %s", mediaType, strings.Join(kinds, " or "), kind), Path: "/payload"}}
+	}
+	return nil
+}
+
+// jsonKind names the JSON type of a decoded value.
+func jsonKind(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func parseDateOrder(expr string) ([]string, error) {
+	parts := strings.Split(expr, "<=")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("date-order %q must compare at least two fields with <=", expr)
+	}
+	fields := make([]string, len(parts))
+	for i, part := range parts {
+		fields[i] = strings.TrimSpace(part)
+		if fields[i] == "" {
+			return nil, fmt.Errorf("date-order %q contains an empty field path", expr)
+		}
+	}
+	return fields, nil
+}
+
+// checkDateOrder requires each field to be at or before the next one.
+func checkDateOrder(packet map[string]any, fields []string) []Issue {
+	times := make([]time.Time, len(fields))
+	for i, field := range fields {
+		v, ok := lookupField(packet, field)
+		if !ok {
+			return []Issue{{Code: "DATE_ORDER_VIOLATION", Message: fmt.Sprintf("%s is missing (required by --date-order)", field), Path: fieldPointer(field)}}
+		}
+		s, ok := v.(string)
+		if !ok {
+			return []Issue{{Code: "DATE_ORDER_VIOLATION", Message: fmt.Sprintf("%s must be an RFC3339 string", field), Path: fieldPointer(field)}}
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return []Issue{{Code: "DATE_ORDER_VIOLATION", Message: fmt.Sprintf("%s is not a valid RFC3339 timestamp: %v", field, err), Path: fieldPointer(field)}}
+		}
+		times[i] = t
+	}
+	for i := 1; i < len(times); i++ {
+		if times[i].Before(times[i-1]) {
+			msg := fmt.Sprintf("%s (%s) must not be after %s (%s)", fields[i-1], times[i-1].Format(time.RFC3339Nano), fields[i], times[i].Format(time.RFC3339Nano))
+			return []Issue{{Code: "DATE_ORDER_VIOLATION", Message: msg, Path: fieldPointer(fields[i])}}
+		}
+	}
+	return nil
+}
+
+// checkDurationField applies the ttl grammar to another field. As with
+// --max-array, an absent field passes.
+func checkDurationField(packet map[string]any, field string) []Issue {
+	val, ok := lookupField(packet, field)
+	if !ok {
+		return nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return []Issue{{Code: "DURATION_INVALID", Message: fmt.Sprintf("%s must be a string", field), Path: fieldPointer(field)}}
+	}
+	if _, err := parseDuration(s, field); err != nil {
+		return []Issue{{Code: "DURATION_INVALID", Message: err.Error(), Path: fieldPointer(field)}}
+	}
+	return nil
+}
+
+// checkSemver requires a field to be a strict SemVer 2.0.0 version and, for
+// --semver-constraint, to satisfy the range. An absent field passes.
+func checkSemver(packet map[string]any, rule semverRule) []Issue {
+	val, ok := lookupField(packet, rule.field)
+	if !ok {
+		return nil
+	}
+	s, ok := val.(string)
+	if !ok {
+		return []Issue{{Code: "VERSION_NOT_SEMVER", Message: fmt.Sprintf("%s must be a string", rule.field), Path: fieldPointer(rule.field)}}
+	}
+	ver, err := semver.StrictNewVersion(s)
+	if err != nil {
+		return []Issue{{Code: "VERSION_NOT_SEMVER", Message: fmt.Sprintf("%s %q is not a semantic version: %v", rule.field, s, err), Path: fieldPointer(rule.field)}}
+	}
+	if rule.constraint == nil {
+		return nil
+	}
+	if ok, errs := rule.constraint.Validate(ver); !ok {
+		reasons := make([]string, len(errs))
+		for i, e := range errs {
+			reasons[i] = e.Error()
+		}
+		return []Issue{{Code: "VERSION_CONSTRAINT_VIOLATION", Message: fmt.Sprintf("%s %s does not satisfy %s: %s", rule.field, s, rule.raw, strings.Join(reasons, "; ")), Path: fieldPointer(rule.field)}}
+	}
+	return nil
+}
+
+// resolveSkews returns the expiry and future-created_at tolerances. Each of
+// --expiry-skew and --future-skew, or its older name --allow-future-created-at,
+// wins over --skew, which wins over the defaults: --clock-skew for expiry and
+// allowFuture's default for the future.
+func resolveSkews(clockSkew time.Duration, skew, expiry, future, allowFuture string, allowFutureSet bool) (expirySkew, futureSkew time.Duration, err error) {
+	if future != "" && allowFutureSet {
+		return 0, 0, fmt.Errorf("--future-skew and --allow-future-created-at are the same setting; give only one")
+	}
+	expirySkew = clockSkew
+	switch {
+	case expiry != "":
+		expirySkew, err = parseDuration(expiry, "expiry-skew")
+	case skew != "":
+		expirySkew, err = parseDuration(skew, "skew")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case future != "":
+		futureSkew, err = parseDuration(future, "future-skew")
+	case skew != "" && !allowFutureSet:
+		futureSkew, err = parseDuration(skew, "skew")
+	default:
+		futureSkew, err = parseDuration(allowFuture, "allow-future-created-at")
+	}
+	return expirySkew, futureSkew, err
+}
+
+// parseMetadataCheck returns the object whose keys are checked and the
+// pattern they must match, or "" and nil when keys are not checked. A pattern
+// given without a field checks the conventional metadata object rather than
+// nothing.
+func parseMetadataCheck(field, pattern string, patternSet bool) (string, *regexp.Regexp, error) {
+	if field == "" && !patternSet {
+		return "", nil, nil
+	}
+	if field == "" {
+		field = "metadata"
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	return field, re, nil
+}
+
+// checkMetadataKeys requires every key of the object at field to match re,
+// reporting all offenders in one issue. An absent field passes.
+func checkMetadataKeys(packet map[string]any, field string, re *regexp.Regexp) []Issue {
+	val, ok := lookupField(packet, field)
+	if !ok {
+		return nil
+	}
+	obj, ok := val.(map[string]any)
+	if !ok {
+		return []Issue{{Code: "METADATA_TYPE_MISMATCH", Message: fmt.Sprintf("%s must be an object (required by --metadata-field)", field), Path: fieldPointer(field)}}
+	}
+	var bad []string
+	for _, key := range sortedKeys(obj) {
+		if !re.MatchString(key) {
+			bad = append(bad, strconv.Quote(key))
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	return []Issue{{Code: "METADATA_KEY_INVALID", Message: fmt.Sprintf("%s keys %s do not match %s", field, strings.Join(bad, ", "), re), Path: fieldPointer(field)}}
+}
+
+// checkArrayLength enforces a --max-array limit. An absent field passes;
+// requiring it is the schema's job.
+func checkArrayLength(packet map[string]any, limit arrayLimit) []Issue {
+	val, ok := lookupField(packet, limit.field)
+	if !ok {
+		return nil
+	}
+	arr, ok := val.([]any)
+	if !ok {
+		return []Issue{{Code: "ARRAY_TYPE_MISMATCH", Message: fmt.Sprintf("%s must be an array (required by --max-array)", limit.field), Path: fieldPointer(limit.field)}}
+	}
+	if len(arr) > limit.max {
+		return []Issue{{Code: "ARRAY_TOO_LONG", Message: fmt.Sprintf("%s has %d elements, more than the maximum of %d", limit.field, len(arr), limit.max), Path: fieldPointer(limit.field)}}
+	}
+	return nil
+}
+
+// checkDepth fails when the packet, or the named field, nests more than max
+// objects or arrays deep. The packet itself is depth 1.
+func checkDepth(packet map[string]any, field string, max int) []Issue {
+	var root any = packet
+	rootPath, label := "", "packet"
+	if field != "" {
+		val, ok := lookupField(packet, field)
+		if !ok {
+			return nil
+		}
+		root, rootPath, label = val, fieldPointer(field), field
+	}
+	depth, deepest := jsonDepth(root, rootPath)
+	if depth <= max {
+		return nil
+	}
+	return []Issue{{
+		Code:    "DEPTH_EXCEEDED",
+		Message: fmt.Sprintf("%s is nested %d levels deep, more than the maximum of %d; deepest point is %s", label, depth, max, deepest),
+		Path:    deepest,
+	}}
+}
+
+// jsonDepth returns the container depth of v and the JSON pointer of its
+// deepest container, preferring the first in sorted-key order on ties.
+func jsonDepth(v any, path string) (int, string) {
+	best, bestPath := 0, path
+	switch val := v.(type) {
+	case map[string]any:
+		for _, k := range sortedKeys(val) {
+			if d, p := jsonDepth(val[k], path+"/"+escapePointer(k)); d > best {
+				best, bestPath = d, p
+			}
+		}
+	case []any:
+		for i, item := range val {
+			if d, p := jsonDepth(item, fmt.Sprintf("%s/%d", path, i)); d > best {
+				best, bestPath = d, p
+			}
+		}
+	default:
+		return 0, path
+	}
+	return best + 1, bestPath
+}
+
+// checkMidnightUTC flags packets in which at least threshold timestamps sit
+// exactly on midnight with a zero UTC offset. One known producer emits local
+// midnight stamped as UTC, so a cluster of these is a hint, not proof.
+func checkMidnightUTC(packet map[string]any, threshold int) []Issue {
+	var paths []string
+	walkStrings(packet, "", func(path, s string) {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return
+		}
+		if _, offset := t.Zone(); offset != 0 {
+			return
+		}
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			paths = append(paths, path)
+		}
+	})
+	if len(paths) < threshold {
+		return nil
+	}
+	return []Issue{{
+		Code:     "TIME_SUSPICIOUS_MIDNIGHT",
+		Message:  fmt.Sprintf("%d timestamps fall exactly on UTC midnight (%s); check the producer is not emitting local time as UTC", len(paths), strings.Join(paths, ", ")),
+		Severity: severityWarning,
+	}}
+}
+
+// walkStrings calls fn with the JSON pointer of every string value, visiting
+// object keys in sorted order.
+func walkStrings(v any, path string, fn func(path, s string)) {
+	switch val := v.(type) {
+	case string:
+		fn(path, val)
+	case map[string]any:
+		for _, k := range sortedKeys(val) {
+			walkStrings(val[k], path+"/"+escapePointer(k), fn)
+		}
+	case []any:
+		for i, item := range val {
+			walkStrings(item, fmt.Sprintf("%s/%d", path, i), fn)
+		}
+	}
+}
+
+// trimStringValues strips surrounding whitespace from every string value in
+// place. Object keys are left alone.
+func trimStringValues(v any) any {
+	switch val := v.(type) {
+	case string:
+		return strings.TrimSpace(val)
+	case map[string]any:
+		for k, item := range val {
+			val[k] = trimStringValues(item)
+		}
+	case []any:
+		for i, item := range val {
+			val[i] = trimStringValues(item)
+		}
+	}
+	return v
+}
+
+// lookupField resolves a dotted path such as "payload.effective_from".
+func lookupField(packet map[string]any, path string) (any, bool) {
+	var cur any = packet
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = obj[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// fieldPointer converts a dotted field path to the JSON pointer used in issue paths.
+func fieldPointer(path string) string {
+	var b strings.Builder
+	for _, key := range strings.Split(path, ".") {
+		b.WriteString("/" + escapePointer(key))
+	}
+	return b.String()
+}
+
+// resolvePointer looks up an RFC 6901 JSON pointer in a decoded document.
+func resolvePointer(doc any, ptr string) (any, bool) {
+	if ptr == "" {
+		return doc, true
+	}
+	cur := doc
+	for _, token := range strings.Split(strings.TrimPrefix(ptr, "/"), "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch node := cur.(type) {
+		case map[string]any:
+			val, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+			cur = val
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) || token != strconv.Itoa(i) {
+				return nil, false
+			}
+			cur = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// expandEnv replaces each ${NAME} in path with that environment variable, so
+// a wrapper can pass schemas/${ENV}/schema.json through unexpanded. Only the
+// braced form is recognized; a bare $ is kept as is, and $${NAME} stands for
+// a literal ${NAME}. A variable that is not set is an error rather than an
+// empty string.
+func expandEnv(path string) (string, error) {
+	var missing []string
+	out := envRefRe.ReplaceAllStringFunc(path, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s in %q is not set", strings.Join(missing, ", "), path)
+	}
+	return out, nil
+}
+
+// setField stores val at a dotted path, creating missing parent objects.
+func setField(packet map[string]any, path string, val any) error {
+	keys := strings.Split(path, ".")
+	obj := packet
+	for i, key := range keys[:len(keys)-1] {
+		next, ok := obj[key]
+		if !ok {
+			child := map[string]any{}
+			obj[key] = child
+			obj = child
+			continue
+		}
+		if obj, ok = next.(map[string]any); !ok {
+			return fmt.Errorf("%s is not an object", strings.Join(keys[:i+1], "."))
+		}
+	}
+	obj[keys[len(keys)-1]] = val
+	return nil
+}
+
+// deleteField removes the field at a dotted path, if present.
+func deleteField(packet map[string]any, path string) {
+	keys := strings.Split(path, ".")
+	parent := packet
+	if len(keys) > 1 {
+		v, ok := lookupField(packet, strings.Join(keys[:len(keys)-1], "."))
+		if parent, ok = v.(map[string]any); !ok {
+			return
+		}
+	}
+	delete(parent, keys[len(keys)-1])
+}
+
+// printValue writes strings bare, like jq -r, and anything else as JSON.
+func printValue(w io.Writer, val any) {
+	if s, ok := val.(string); ok {
+		fmt.Fprintln(w, s)
+		return
+	}
+	writeReport(w, val)
+}
+
+func escapePointer(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	return strings.ReplaceAll(key, "/", "~1")
+}
+
+// ntpEpochOffset is the number of seconds between 1900-01-01 and 1970-01-01.
+const ntpEpochOffset = 2208988800
+
+// queryNTP performs a single SNTP (RFC 4330) exchange and returns how far the
+// local clock is behind the server; add it to time.Now() to correct.
+func queryNTP(server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x1B // LI = 0, VN = 3, Mode = 3 (client)
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, errors.New("short ntp response")
+	}
+	if resp[0]>>6 == 3 {
+		return 0, errors.New("ntp server clock is unsynchronized")
+	}
+	if mode := resp[0] & 0x07; mode != 4 {
+		return 0, fmt.Errorf("unexpected ntp mode %d", mode)
+	}
+	if resp[1] == 0 {
+		return 0, errors.New("ntp server sent kiss-of-death")
+	}
+
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(secs, (frac*1e9)>>32)
+}
+
+func exitCodeFor(failed int) int {
+	if failed == 0 {
+		return 0
+	}
+	if !countExit {
+		return 1
+	}
+	if failed > maxCountExit {
+		return maxCountExit
+	}
+	return failed
+}
+
+// writeResultFile writes res to dir/<name minus extension>.result.json,
+// keeping any directories in name.
+func writeResultFile(dir, name string, res Result) error {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing to write result for %q outside %s", name, dir)
+	}
+	target := filepath.Join(dir, strings.TrimSuffix(rel, filepath.Ext(rel))+".result.json")
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeReport(&buf, res)
+	return writeFileAtomic(target, buf.Bytes())
+}
+
+// auditLog appends one JSON line per validation outcome. Each line is written
+// with a single unbuffered write to a file opened for appending, so lines from
+// concurrent requests never interleave and nothing is lost on exit.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// auditEntry is one --audit-log line. Packet is the path, archive entry, or,
+// in server mode, the client address.
+type auditEntry struct {
+	Time      string   `json:"time"`
+	Packet    string   `json:"packet,omitempty"`
+	ContextID string   `json:"context_id,omitempty"`
+	OK        bool     `json:"ok"`
+	Codes     []string `json:"codes"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+func (a *auditLog) record(at time.Time, packet string, res Result) error {
+	entry := auditEntry{Time: at.Format(time.RFC3339Nano), Packet: packet, OK: res.OK, Codes: []string{}}
+	entry.ContextID, _ = res.packet["context_id"].(string)
+	for _, is := range res.Issues {
+		entry.Codes = append(entry.Codes, is.Code)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(append(line, '\n'))
+	return err
+}
+
+// writeFileAtomic replaces target with data via a rename, so a reader never
+// sees a partial file.
+func writeFileAtomic(target string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".result-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func failTooling(code string, err any) {
+	emit(toolingFailure(code, err))
 	os.Exit(2)
 }
 
-func emitFailure(code string, err any) {
-	out := map[string]any{
-		"ok": false,
-		"issues": []map[string]string{
-			{"code": code, "message": fmt.Sprint(err)},
-		},
+func emit(out any) {
+	if issueTemplate != nil {
+		if err := writeIssues(os.Stdout, issueTemplate, out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	writeReport(os.Stdout, out)
+}
+
+// issueLine is what a --template is executed against: one issue, with the
+// metadata of the packet it belongs to.
+type issueLine struct {
+	Issue
+	Packet        string
+	OK            bool
+	SchemaVersion string
+	Schema        string
+	ContextID     string
+}
+
+// parseIssueTemplate also executes the template once against an empty issue,
+// so a misspelled field fails at startup rather than on the first issue.
+func parseIssueTemplate(src string) (*template.Template, error) {
+	tmpl, err := template.New("--template").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, issueLine{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// writeIssues renders every issue of a result or batch report through tmpl,
+// one per line. A report's own issues, such as MAX_PACKETS, come last with no
+// packet. Output that is neither is written as JSON.
+func writeIssues(w io.Writer, tmpl *template.Template, out any) error {
+	var lines []issueLine
+	switch out := out.(type) {
+	case Result:
+		lines = appendIssueLines(lines, out)
+	case batchReport:
+		for _, r := range out.Results {
+			lines = appendIssueLines(lines, r)
+		}
+		for _, is := range out.Issues {
+			lines = append(lines, issueLine{Issue: is, OK: out.OK})
+		}
+	default:
+		writeReport(w, out)
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if err := tmpl.Execute(&buf, line); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func appendIssueLines(lines []issueLine, r Result) []issueLine {
+	contextID, _ := r.packet["context_id"].(string)
+	for _, is := range r.Issues {
+		lines = append(lines, issueLine{Issue: is, Packet: r.Packet, OK: r.OK, SchemaVersion: r.SchemaVersion, Schema: r.Schema, ContextID: contextID})
 	}
-	b, marshalErr := json.MarshalIndent(out, "", "  ")
-	if marshalErr != nil {
-		fmt.Printf("{\"ok\":false,\"issues\":[{\"code\":\"%s\",\"message\":\"failed to serialize error response: %s\"}]}\n", code, marshalErr)
+	return lines
+}
+
+func writeReport(w io.Writer, out any) {
+	b, err := encodeIndented(out, "")
+	if err != nil {
+		fmt.Fprintf(w, "{\"ok\":false,\"issues\":[{\"code\":\"OUTPUT_ERROR\",\"message\":\"failed to serialize response: %s\"}]}\n", err)
 		return
 	}
-	fmt.Println(string(b))
+	w.Write(b)
+}
+
+// encodeIndented encodes out as writeReport prints it, with prefix before
+// every line but the first.
+func encodeIndented(out any, prefix string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(prefix, "  ")
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,1105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfeen87/Context-Broker/src/contextbroker"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["schema_version", "context_id", "created_at", "ttl", "expires_at"],
+  "properties": {
+    "schema_version": {"type": "string"},
+    "context_id": {"type": "string"},
+    "created_at": {"type": "string", "format": "date-time"},
+    "ttl": {"type": "string"},
+    "expires_at": {"type": "string", "format": "date-time"}
+  }
+}`
+
+func testValidator(t testing.TB) *validator {
+	t.Helper()
+	schema, err := compileInlineSchema(testSchema)
+	if err != nil {
+		t.Fatalf("compile test schema: %v", err)
+	}
+	return &validator{
+		candidates:  []namedSchema{{name: "inline", schema: schema}},
+		clockSkew:   time.Minute,
+		expirySkew:  time.Minute,
+		allowFuture: 5 * time.Minute,
+	}
+}
+
+func testPacket(t testing.TB, now time.Time, overrides map[string]any) []byte {
+	t.Helper()
+	packet := map[string]any{
+		"schema_version": "1.0.0",
+		"context_id":     "ctx_test_001",
+		"created_at":     now.Format(time.RFC3339),
+		"ttl":            "1h",
+		"expires_at":     now.Add(time.Hour).Format(time.RFC3339),
+	}
+	for k, v := range overrides {
+		packet[k] = v
+	}
+	b, err := json.Marshal(packet)
+	if err != nil {
+		t.Fatalf("marshal test packet: %v", err)
+	}
+	return b
+}
+
+func postPacket(h http.Handler, body []byte) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+	return rec
+}
+
+func TestServerRejectsRequestsBeyondInflightCap(t *testing.T) {
+	now := time.Now().UTC()
+	s := newServer(testValidator(t), func() time.Time { return now }, 1, 0, maxPacketBytes)
+	h := s.routes()
+	body := testPacket(t, now, nil)
+
+	s.inflight <- struct{}{} // occupy the only slot
+	if rec := postPacket(h, body); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status with cap reached = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+
+	<-s.inflight
+	if rec := postPacket(h, body); rec.Code != http.StatusOK {
+		t.Fatalf("status with free slot = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if len(s.inflight) != 0 {
+		t.Fatalf("inflight slots still held after request: %d", len(s.inflight))
+	}
+}
+
+func TestServerQueuesUntilSlotFrees(t *testing.T) {
+	now := time.Now().UTC()
+	s := newServer(testValidator(t), func() time.Time { return now }, 1, 5*time.Second, maxPacketBytes)
+	h := s.routes()
+
+	s.inflight <- struct{}{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-s.inflight
+	}()
+	if rec := postPacket(h, testPacket(t, now, nil)); rec.Code != http.StatusOK {
+		t.Fatalf("queued request status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestServerRejectsOversizedBody(t *testing.T) {
+	now := time.Now().UTC()
+	s := newServer(testValidator(t), func() time.Time { return now }, 0, 0, 64)
+	body := testPacket(t, now, map[string]any{"context_id": string(bytes.Repeat([]byte("x"), 128))})
+	if rec := postPacket(s.routes(), body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// ownerRequired is an example custom check written against the
+// contextbroker package, as an embedder would.
+var ownerRequired = contextbroker.CheckFunc(func(packet map[string]any, now time.Time) []contextbroker.Issue {
+	if _, ok := packet["owner"]; !ok {
+		return []contextbroker.Issue{{Code: "OWNER_MISSING", Message: "owner is required", Path: "/owner"}}
+	}
+	return nil
+})
+
+func TestCustomChecksRunAfterBuiltins(t *testing.T) {
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.checks = []contextbroker.Check{ownerRequired, contextbroker.ContextIDPrefix("team_")}
+
+	res := v.validate(testPacket(t, now, map[string]any{"context_id": "team_001", "owner": "ops"}), now)
+	if !res.OK {
+		t.Fatalf("packet passing both checks rejected: %+v", res.Issues)
+	}
+
+	expired := testPacket(t, now, map[string]any{
+		"created_at": now.Add(-2 * time.Hour).Format(time.RFC3339),
+		"expires_at": now.Add(-time.Hour).Format(time.RFC3339),
+	})
+	res = v.validate(expired, now)
+	if res.OK {
+		t.Fatal("packet failing the checks accepted")
+	}
+	var codes []string
+	for _, is := range res.Issues {
+		codes = append(codes, is.Code)
+	}
+	if got := strings.Join(codes, ","); got != "TIME_EXPIRED,OWNER_MISSING,CONTEXT_ID_PREFIX" {
+		t.Fatalf("issue codes = %s, want built-in issues before custom ones, in order", got)
+	}
+}
+
+func TestReplayProtectionRejectsDuplicates(t *testing.T) {
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.replayField = "context_id"
+	v.replay = newMemoryNonceStore(10)
+	body := testPacket(t, now, nil)
+
+	var wg sync.WaitGroup
+	results := make([]Result, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = v.validate(body, now)
+		}(i)
+	}
+	wg.Wait()
+	accepted := 0
+	for _, res := range results {
+		if res.OK {
+			accepted++
+		} else if res.Issues[0].Code != "REPLAY_DETECTED" {
+			t.Fatalf("unexpected rejection: %+v", res.Issues)
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("accepted %d copies of the same packet, want 1", accepted)
+	}
+
+	if res := v.validate(body, now.Add(2*time.Hour)); res.OK {
+		t.Fatal("expired packet accepted")
+	}
+}
+
+func TestMemoryNonceStoreFailsClosedWhenFull(t *testing.T) {
+	now := time.Now()
+	m := newMemoryNonceStore(2)
+	m.Record("soon", now.Add(time.Minute), now)
+	m.Record("later", now.Add(time.Hour), now)
+
+	if _, err := m.Record("third", now.Add(time.Hour), now); err != errNonceStoreFull {
+		t.Fatalf("third: err = %v, want errNonceStoreFull", err)
+	}
+	for _, nonce := range []string{"soon", "later"} {
+		if fresh, err := m.Record(nonce, now.Add(time.Hour), now); fresh || err != nil {
+			t.Fatalf("%s: fresh=%v err=%v, want a replay: live entries must not be evicted", nonce, fresh, err)
+		}
+	}
+
+	// Once the earliest entry expires, its slot is free again.
+	later := now.Add(2 * time.Minute)
+	if fresh, err := m.Record("third", now.Add(time.Hour), later); !fresh || err != nil {
+		t.Fatalf("third after soon expired: fresh=%v err=%v", fresh, err)
+	}
+	if len(m.entries) != 2 || len(m.byExp) != 2 {
+		t.Fatalf("store holds %d entries and %d heap items, want 2", len(m.entries), len(m.byExp))
+	}
+}
+
+func TestReplayProtectionWithFullCache(t *testing.T) {
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.replayField = "context_id"
+	v.replay = newMemoryNonceStore(3)
+	packet := func(id string) []byte { return testPacket(t, now, map[string]any{"context_id": id}) }
+	for i := 0; i < 3; i++ {
+		if res := v.validate(packet(fmt.Sprintf("ctx_%d", i)), now); !res.OK {
+			t.Fatalf("ctx_%d: %+v", i, res.Issues)
+		}
+	}
+
+	res := v.validate(packet("ctx_new"), now)
+	if res.OK || !res.tooling || len(res.Issues) != 1 || res.Issues[0].Code != "REPLAY_CACHE_FULL" {
+		t.Fatalf("new packet on a full cache: %+v, want a REPLAY_CACHE_FULL tooling failure", res)
+	}
+	for i := 0; i < 3; i++ {
+		res := v.validate(packet(fmt.Sprintf("ctx_%d", i)), now)
+		if res.OK || res.Issues[0].Code != "REPLAY_DETECTED" {
+			t.Errorf("replay of ctx_%d on a full cache: %+v, want REPLAY_DETECTED", i, res.Issues)
+		}
+	}
+}
+
+func TestServerSelectsSchemaByKind(t *testing.T) {
+	now := time.Now().UTC()
+	sensor, err := compileInlineSchema(`{"type": "object", "required": ["sensor_id"]}`)
+	if err != nil {
+		t.Fatalf("compile sensor schema: %v", err)
+	}
+	s := newServer(testValidator(t), func() time.Time { return now }, 0, 0, maxPacketBytes)
+	s.kinds = map[string]namedSchema{"sensor": {name: "sensor", schema: sensor}}
+	h := s.routes()
+	body := testPacket(t, now, nil)
+
+	for kind, want := range map[string]int{
+		"":       http.StatusOK,
+		"sensor": http.StatusUnprocessableEntity,
+		"other":  http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+		if kind != "" {
+			req.Header.Set(packetKindHeader, kind)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("kind %q: status = %d, want %d: %s", kind, rec.Code, want, rec.Body)
+		}
+	}
+}
+
+func TestEachArrayPacket(t *testing.T) {
+	var names []string
+	collect := func(name string, data []byte, err error) bool {
+		names = append(names, name)
+		return true
+	}
+	if _, err := eachArrayPacket(strings.NewReader(`[{"a": 1}, {"b": 2}]`), 0, collect); err != nil {
+		t.Fatalf("valid array: %v", err)
+	}
+	if got := strings.Join(names, ","); got != "stdin[0],stdin[1]" {
+		t.Fatalf("names = %s", got)
+	}
+
+	for _, in := range []string{``, `{}`, `[{}`, `[{}] []`} {
+		_, err := eachArrayPacket(strings.NewReader(in), 0, collect)
+		if _, ok := err.(*collectionParseError); !ok {
+			t.Errorf("input %q: err = %v, want *collectionParseError", in, err)
+		}
+	}
+}
+
+func TestServerAuditsEveryRequest(t *testing.T) {
+	now := time.Now().UTC()
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(logPath)
+	if err != nil {
+		t.Fatalf("open audit log: %v", err)
+	}
+	s := newServer(testValidator(t), func() time.Time { return now }, 0, 0, maxPacketBytes)
+	s.audit = audit
+	h := s.routes()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postPacket(h, testPacket(t, now, nil))
+		}()
+	}
+	wg.Wait()
+	postPacket(h, []byte("{"))
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 9 {
+		t.Fatalf("audit log has %d lines, want 9", len(lines))
+	}
+	for _, line := range lines {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("audit line %q: %v", line, err)
+		}
+	}
+	var last auditEntry
+	json.Unmarshal([]byte(lines[8]), &last)
+	if last.OK || len(last.Codes) != 1 || last.Codes[0] != "PACKET_PARSE_ERROR" {
+		t.Fatalf("last audit entry = %+v, want a PACKET_PARSE_ERROR failure", last)
+	}
+}
+
+// schemaCandidates returns n candidates that each require a different field,
+// followed by the test schema, so only the last one accepts testPacket.
+func schemaCandidates(tb testing.TB, n int) []namedSchema {
+	tb.Helper()
+	var candidates []namedSchema
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("reject%d", i)
+		schema, err := compileInlineSchema(fmt.Sprintf(`{"type": "object", "required": [%q]}`, name))
+		if err != nil {
+			tb.Fatalf("compile %s: %v", name, err)
+		}
+		candidates = append(candidates, namedSchema{name: name, schema: schema})
+	}
+	schema, err := compileInlineSchema(testSchema)
+	if err != nil {
+		tb.Fatalf("compile test schema: %v", err)
+	}
+	return append(candidates, namedSchema{name: "accept", schema: schema})
+}
+
+func TestParallelSchemasPicksFirstListedMatch(t *testing.T) {
+	now := time.Now().UTC()
+	var packet map[string]any
+	json.Unmarshal(testPacket(t, now, nil), &packet)
+
+	candidates := schemaCandidates(t, 4)
+	open, err := compileInlineSchema(`{"type": "object"}`)
+	if err != nil {
+		t.Fatalf("compile open schema: %v", err)
+	}
+	candidates = append(candidates, namedSchema{name: "open", schema: open})
+	for i := 0; i < 50; i++ {
+		if got, _ := matchSchemaParallel(packet, candidates); got.name != "accept" {
+			t.Fatalf("matched %s, want the first-listed match", got.name)
+		}
+	}
+
+	serial, serialIssues := matchSchema(packet, candidates[:4])
+	parallel, parallelIssues := matchSchemaParallel(packet, candidates[:4])
+	if serial.name != parallel.name || len(serialIssues) != len(parallelIssues) {
+		t.Fatalf("no match: parallel picked %s (%d issues), serial %s (%d issues)", parallel.name, len(parallelIssues), serial.name, len(serialIssues))
+	}
+}
+
+func BenchmarkMatchSchema(b *testing.B) {
+	now := time.Now().UTC()
+	var packet map[string]any
+	json.Unmarshal(testPacket(b, now, nil), &packet)
+	candidates := schemaCandidates(b, 15)
+
+	for _, bm := range []struct {
+		name  string
+		match func(map[string]any, []namedSchema) (namedSchema, []Issue)
+	}{{"serial", matchSchema}, {"parallel", matchSchemaParallel}} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bm.match(packet, candidates)
+			}
+		})
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	// dirValidator serves the given schemas from a --schemas-dir as versions
+	// 1.0.0, 1.0.1, and so on.
+	dirValidator := func(schemas ...string) *validator {
+		dir := t.TempDir()
+		for i, src := range schemas {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("context_packet.schema.v1.0.%d.json", i)), []byte(src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &validator{schemasDir: dir, schemas: map[string]*jsonschema.Schema{}}
+	}
+	now := time.Now().UTC()
+	clock := func() time.Time { return now }
+	for name, tc := range map[string]struct {
+		v    *validator
+		want int
+	}{
+		"compiled schema":   {testValidator(t), http.StatusOK},
+		"empty schemas dir": {&validator{schemasDir: t.TempDir()}, http.StatusServiceUnavailable},
+		"schemas dir":       {dirValidator(`{"type": "object"}`), http.StatusOK},
+		"uncompilable":      {dirValidator(`{"type": "object"}`, `{"type": 5}`), http.StatusServiceUnavailable},
+		"malformed":         {dirValidator(`{"type": `), http.StatusServiceUnavailable},
+	} {
+		rec := httptest.NewRecorder()
+		newServer(tc.v, clock, 0, 0, maxPacketBytes).routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d: %s", name, rec.Code, tc.want, rec.Body)
+		}
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	var results []Result
+	for _, p := range []struct{ name, id, parent string }{
+		{"root.json", "root", ""},
+		{"child.json", "child", "root"},
+		{"orphan.json", "orphan", "missing"},
+		{"a.json", "a", "b"},
+		{"b.json", "b", "c"},
+		{"c.json", "c", "a"},
+		{"tail.json", "tail", "a"},
+		{"self.json", "self", "self"},
+	} {
+		packet := map[string]any{"context_id": p.id}
+		if p.parent != "" {
+			packet["parent_id"] = p.parent
+		}
+		results = append(results, Result{Packet: p.name, packet: packet})
+	}
+
+	var got []string
+	for _, is := range checkLinks(results) {
+		got = append(got, is.Code+": "+is.Message)
+	}
+	want := []string{
+		"LINK_DANGLING: orphan.json: parent_id missing of orphan is not the context_id of any packet in the batch",
+		"LINK_CYCLE: parent_id links form a cycle: a -> b -> c -> a",
+		"LINK_CYCLE: parent_id links form a cycle: self -> self",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("issues:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckLinksParentFailsEarly(t *testing.T) {
+	v := testValidator(t)
+	now := time.Now().UTC()
+	root := v.validate(testPacket(t, now, map[string]any{"context_id": "root", "schema_version": ""}), now)
+	if root.OK || root.Issues[0].Code != "UNSUPPORTED_SCHEMA_VERSION" {
+		t.Fatalf("root: %+v, want UNSUPPORTED_SCHEMA_VERSION", root)
+	}
+	child := v.validate(testPacket(t, now, map[string]any{"context_id": "child", "parent_id": "root"}), now)
+	root.Packet, child.Packet = "root.json", "child.json"
+
+	if issues := checkLinks([]Result{root, child}); len(issues) != 0 {
+		t.Errorf("issues = %+v, want none: the failed parent is still in the batch", issues)
+	}
+}
+
+func TestEachDirPacketDoesNotLeakBetweenPackets(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.json": `{"context_id":"` + strings.Repeat("x", 4096) + `"}`,
+		"b.json": `{"context_id":"b"}`,
+		"c.json": `{}`,
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := 0
+	_, _, err := eachDirPacket(dir, time.Time{}, 0, func(name string, data []byte, err error) bool {
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(data) != files[name] {
+			t.Errorf("%s: got %d bytes %.40q, want %.40q", name, len(data), data, files[name])
+		}
+		seen++
+		return true
+	})
+	if err != nil || seen != len(files) {
+		t.Fatalf("visited %d of %d, err %v", seen, len(files), err)
+	}
+}
+
+func TestPooledBuffersDoNotLeakIntoResults(t *testing.T) {
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.canonicalize = true
+	// Large, small, empty, then middling: each read reuses the buffer the
+	// one before it grew, and a leftover tail would break or change it.
+	packets := [][]byte{
+		testPacket(t, now, map[string]any{"context_id": "big", "payload": strings.Repeat("x", 64<<10)}),
+		testPacket(t, now, map[string]any{"context_id": "small"}),
+		[]byte(`{}`),
+		testPacket(t, now, map[string]any{"context_id": "mid", "payload": strings.Repeat("y", 4<<10)}),
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i, p := range packets {
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("%d.json", i), Mode: 0o644, Size: int64(len(p)), Typeflag: tar.TypeReg})
+		tw.Write(p)
+	}
+	tw.Close()
+	archive := filepath.Join(t.TempDir(), "packets.tar")
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report := batchReport{OK: true, Results: []Result{}}
+	_, _, err := eachTarPacket(archive, time.Time{}, 0, func(name string, data []byte, err error) bool {
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		res := v.validate(data, now)
+		res.Packet = name
+		report.add(res)
+		return true
+	})
+	if err != nil || len(report.Results) != len(packets) {
+		t.Fatalf("validated %d of %d, err %v", len(report.Results), len(packets), err)
+	}
+	// Compare only once every buffer has gone back to the pool, so results
+	// that still referred to one would show the last packet's bytes.
+	for i, p := range packets {
+		want := v.validate(p, now)
+		got := report.Results[i]
+		if got.Canonical != want.Canonical || len(got.Issues) != len(want.Issues) || got.packet["context_id"] != want.packet["context_id"] {
+			t.Errorf("%s: result %+v, want %+v", got.Packet, got, want)
+		}
+	}
+}
+
+// BenchmarkBatchValidate runs a --dir batch end to end, reading and
+// validating every file, with fresh reads as before pooling and with the
+// pooled reads eachDirPacket does now.
+func BenchmarkBatchValidate(b *testing.B) {
+	now := time.Now().UTC()
+	dir := b.TempDir()
+	for i := 0; i < 100; i++ {
+		p := testPacket(b, now, map[string]any{"context_id": fmt.Sprintf("ctx_%03d", i), "payload": strings.Repeat("x", (i%8)<<10)})
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%03d.json", i)), p, 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	v := testValidator(b)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			report := batchReport{OK: true, Results: []Result{}}
+			for _, e := range entries {
+				data, err := readPacketFile(filepath.Join(dir, e.Name()))
+				if err != nil {
+					b.Fatal(err)
+				}
+				report.add(v.validate(data, now))
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			report := batchReport{OK: true, Results: []Result{}}
+			if _, _, err := eachDirPacket(dir, time.Time{}, 0, func(name string, data []byte, err error) bool {
+				report.add(v.validate(data, now))
+				return err == nil
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	packet := testPacket(b, time.Now().UTC(), map[string]any{"payload": strings.Repeat("x", 32<<10)})
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := readPacket(bytes.NewReader(packet)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := readPacketPooled(bytes.NewReader(packet))
+			if err != nil {
+				b.Fatal(err)
+			}
+			releasePacket(buf)
+		}
+	})
+}
+
+func TestSignedAtWithinLifetime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	v := testValidator(t)
+	for name, tc := range map[string]struct {
+		signedAt time.Time
+		ok       bool
+	}{
+		"at creation":        {now, true},
+		"within skew before": {now.Add(-30 * time.Second), true},
+		"before creation":    {now.Add(-2 * time.Minute), false},
+		"after expiry":       {now.Add(time.Hour + 2*time.Minute), false},
+	} {
+		res := v.validate(testPacket(t, now, map[string]any{"signed_at": tc.signedAt.Format(time.RFC3339)}), now)
+		if res.OK != tc.ok {
+			t.Errorf("%s: ok = %v, want %v: %+v", name, res.OK, tc.ok, res.Issues)
+		}
+		if !tc.ok && (len(res.Issues) != 1 || res.Issues[0].Code != "SIGNATURE_TIME_OUTSIDE_LIFETIME") {
+			t.Errorf("%s: issues = %+v, want SIGNATURE_TIME_OUTSIDE_LIFETIME", name, res.Issues)
+		}
+	}
+}
+
+func TestGRPCValidate(t *testing.T) {
+	now := time.Now().UTC()
+	s := newServer(testValidator(t), func() time.Time { return now }, 0, 0, maxPacketBytes)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := s.grpcServer()
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msgs := validatorFile.Messages()
+	validate := func(packet []byte, kind string) (*dynamicpb.Message, error) {
+		req := dynamicpb.NewMessage(msgs.ByName("PacketRequest"))
+		req.Set(msgs.ByName("PacketRequest").Fields().ByName("packet"), protoreflect.ValueOfBytes(packet))
+		req.Set(msgs.ByName("PacketRequest").Fields().ByName("kind"), protoreflect.ValueOfString(kind))
+		resp := dynamicpb.NewMessage(msgs.ByName("ValidationResponse"))
+		err := conn.Invoke(context.Background(), "/contextbroker.v1.Validator/Validate", req, resp)
+		return resp, err
+	}
+	fields := msgs.ByName("ValidationResponse").Fields()
+
+	resp, err := validate(testPacket(t, now, nil), "")
+	if err != nil || !resp.Get(fields.ByName("ok")).Bool() {
+		t.Fatalf("valid packet: ok=%v err=%v", resp.Get(fields.ByName("ok")), err)
+	}
+
+	expired := testPacket(t, now, map[string]any{
+		"created_at": now.Add(-2 * time.Hour).Format(time.RFC3339),
+		"expires_at": now.Add(-time.Hour).Format(time.RFC3339),
+	})
+	resp, err = validate(expired, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues := resp.Get(fields.ByName("issues")).List()
+	if resp.Get(fields.ByName("ok")).Bool() || issues.Len() != 1 {
+		t.Fatalf("expired packet: ok=%v with %d issues", resp.Get(fields.ByName("ok")), issues.Len())
+	}
+	if code := issues.Get(0).Message().Get(msgs.ByName("Issue").Fields().ByName("code")).String(); code != "TIME_EXPIRED" {
+		t.Fatalf("issue code = %s, want TIME_EXPIRED", code)
+	}
+
+	if _, err := validate(testPacket(t, now, nil), "nope"); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("unknown kind: err = %v, want InvalidArgument", err)
+	}
+
+	// Reflection is what lets grpcurl call the service without a .proto file.
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "contextbroker.v1.Validator"}})
+	ref, err := stream.Recv()
+	if err != nil || len(ref.GetFileDescriptorResponse().GetFileDescriptorProto()) == 0 {
+		t.Fatalf("reflection: %v %v", ref, err)
+	}
+
+	// A SCHEMA_SKIPPED warning ahead of the error must not become the status.
+	skipped := toolingFailure("SCHEMA_COMPILE_ERROR", "no --schema compiled")
+	skipped.Issues = append([]Issue{{Code: "SCHEMA_SKIPPED", Message: "skipped schema a.json", Severity: severityWarning}}, skipped.Issues...)
+	if _, err := s.rpcRespond(context.Background(), codes.Internal, skipped); !strings.HasPrefix(status.Convert(err).Message(), "SCHEMA_COMPILE_ERROR: ") {
+		t.Errorf("status = %v, want it to name SCHEMA_COMPILE_ERROR", err)
+	}
+}
+
+func TestEnumCaseInsensitive(t *testing.T) {
+	schema, err := compileInlineSchema(`{"type": "object", "properties": {"severity": {"enum": ["LOW", "MEDIUM", "HIGH"]}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.candidates = []namedSchema{{name: "inline", schema: schema}}
+	v.enumCaseFields = []string{"severity"}
+	v.canonicalize = true
+
+	res := v.validate(testPacket(t, now, map[string]any{"severity": "low"}), now)
+	if !res.OK || len(res.Issues) != 1 || res.Issues[0].Code != "ENUM_CASE_MISMATCH" {
+		t.Fatalf("low: ok=%v issues=%+v, want one ENUM_CASE_MISMATCH warning", res.OK, res.Issues)
+	}
+	if !strings.Contains(res.Canonical, `"severity":"LOW"`) {
+		t.Fatalf("canonical form not rewritten: %s", res.Canonical)
+	}
+
+	if res := v.validate(testPacket(t, now, map[string]any{"severity": "lo"}), now); res.OK {
+		t.Fatal("value outside the enum accepted")
+	}
+}
+
+func TestPolicyDecision(t *testing.T) {
+	saved := retryBackoff
+	t.Cleanup(func() { retryBackoff = saved })
+	retryBackoff = time.Millisecond
+
+	calls := 0
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var body struct {
+			Input map[string]any `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch body.Input["context_id"] {
+		case "ctx_allowed":
+			fmt.Fprint(w, `{"result": true}`)
+		case "ctx_denied":
+			fmt.Fprint(w, `{"result": {"allow": false, "reasons": ["producer is embargoed"]}}`)
+		case "ctx_undefined":
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer policy.Close()
+
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.policy = &policyClient{url: policy.URL, client: policy.Client(), retries: 2}
+	for id, want := range map[string]string{
+		"ctx_allowed":   "",
+		"ctx_denied":    "POLICY_DENIED",
+		"ctx_undefined": "POLICY_UNAVAILABLE",
+		"ctx_down":      "POLICY_UNAVAILABLE",
+	} {
+		calls = 0
+		res := v.validate(testPacket(t, now, map[string]any{"context_id": id}), now)
+		got := ""
+		if len(res.Issues) > 0 {
+			got = res.Issues[0].Code
+		}
+		if got != want || res.OK != (want == "") {
+			t.Errorf("%s: ok=%v issues=%+v, want %q", id, res.OK, res.Issues, want)
+		}
+		if id == "ctx_denied" && !strings.Contains(res.Issues[0].Message, "producer is embargoed") {
+			t.Errorf("denial does not carry the policy's reason: %s", res.Issues[0].Message)
+		}
+		if id == "ctx_down" && calls != 3 {
+			t.Errorf("unavailable service called %d times, want 3 with 2 retries", calls)
+		}
+	}
+
+	expired := testPacket(t, now, map[string]any{"context_id": "ctx_allowed", "expires_at": now.Add(-time.Hour).Format(time.RFC3339)})
+	calls = 0
+	if v.validate(expired, now); calls != 0 {
+		t.Error("policy consulted for a packet that failed built-in checks")
+	}
+}
+
+func TestSchemaErrorLocations(t *testing.T) {
+	for name, tc := range map[string]struct {
+		src, code, path, message string
+	}{
+		"malformed":   {"{\n  \"type\": \"object\",\n}", "SCHEMA_LOAD_ERROR", "", "s.json:3:1: "},
+		"bad keyword": {`{"properties": {"a": {"type": 5}}}`, "SCHEMA_COMPILE_ERROR", "/properties/a/type", "s.json at /properties/a/type: "},
+		"bad ref":     {`{"$ref": "#/nope"}`, "SCHEMA_COMPILE_ERROR", "", "s.json: #/nope not found"},
+	} {
+		_, code, err := compileSchema("s.json", []byte(tc.src), "SCHEMA_LOAD_ERROR")
+		if code != tc.code {
+			t.Errorf("%s: code = %q, want %q", name, code, tc.code)
+		}
+		var res Result
+		res.fail(code, err)
+		if res.Schema != "s.json" || len(res.Issues) == 0 {
+			t.Fatalf("%s: result = %+v, want issues naming s.json", name, res)
+		}
+		if is := res.Issues[0]; is.Path != tc.path || !strings.HasPrefix(is.Message, tc.message) {
+			t.Errorf("%s: issue = %+v, want path %q and message starting %q", name, is, tc.path, tc.message)
+		}
+	}
+}
+
+func TestCappedBatchExitCode(t *testing.T) {
+	for name, tc := range map[string]struct {
+		report batchReport
+		want   int
+	}{
+		"complete":       {batchReport{OK: true, Total: 3}, 0},
+		"capped":         {batchReport{OK: true, Total: 2, Capped: 1, CapHit: true}, exitCapped},
+		"capped stream":  {batchReport{OK: true, Total: 2, CapHit: true}, exitCapped},
+		"capped invalid": {batchReport{Total: 2, Failed: 1, Capped: 1, CapHit: true}, 1},
+		"capped tooling": {batchReport{Total: 2, Capped: 1, CapHit: true, tooling: true}, 2},
+	} {
+		if got := tc.report.exitCode(); got != tc.want {
+			t.Errorf("%s: exit code = %d, want %d", name, got, tc.want)
+		}
+	}
+}
+
+// poisonReader fails the test if anything reads it.
+type poisonReader struct{ t *testing.T }
+
+func (p poisonReader) Read([]byte) (int, error) {
+	p.t.Error("input read past --max-packets")
+	return 0, io.EOF
+}
+
+func TestMaxPacketsStopsReading(t *testing.T) {
+	var names []string
+	collect := func(name string, data []byte, err error) bool {
+		names = append(names, name)
+		return true
+	}
+
+	// The second element is left undecoded and the rest of stdin unread.
+	in := io.MultiReader(strings.NewReader(`[{"a": 1}, {"b": `), poisonReader{t})
+	capped, err := eachArrayPacket(in, 1, collect)
+	if err != nil || !capped || strings.Join(names, ",") != "stdin[0]" {
+		t.Errorf("array: capped=%v err=%v names=%v, want capped after stdin[0]", capped, err, names)
+	}
+	names = nil
+	capped, err = eachArrayPacket(strings.NewReader(`[{"a": 1}]`), 1, collect)
+	if err != nil || capped {
+		t.Errorf("array at the cap: capped=%v err=%v, want not capped", capped, err)
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.json", "b.json", "c.json", "d.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(`{}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names = nil
+	_, n, err := eachDirPacket(dir, time.Time{}, 2, collect)
+	if err != nil || n != 2 || strings.Join(names, ",") != "a.json,b.json" {
+		t.Errorf("dir: capped=%d err=%v names=%v, want 2 capped after a.json,b.json", n, err, names)
+	}
+
+	archive := filepath.Join(t.TempDir(), "packets.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.json", "b.json", "c.json"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 2, Typeflag: tar.TypeReg})
+		tw.Write([]byte(`{}`))
+	}
+	tw.Close()
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	_, n, err = eachTarPacket(archive, time.Time{}, 1, collect)
+	if err != nil || n != 2 || strings.Join(names, ",") != "a.json" {
+		t.Errorf("tar: capped=%d err=%v names=%v, want 2 capped after a.json", n, err, names)
+	}
+}
+
+func TestEpochAlignment(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	v := testValidator(t)
+	v.epochInterval = time.Hour
+	start := now.Add(-5 * time.Hour).Format(time.RFC3339)
+	for name, tc := range map[string]struct {
+		overrides map[string]any
+		path      string
+	}{
+		"on grid":      {map[string]any{"generation": 5, "epoch_start": start}, ""},
+		"no epoch":     {map[string]any{}, ""},
+		"off grid":     {map[string]any{"generation": 4, "epoch_start": start}, "/created_at"},
+		"fractional":   {map[string]any{"generation": 4.5, "epoch_start": start}, "/generation"},
+		"bad start":    {map[string]any{"generation": 5, "epoch_start": "yesterday"}, "/epoch_start"},
+		"missing half": {map[string]any{"epoch_start": start}, "/generation"},
+	} {
+		res := v.validate(testPacket(t, now, tc.overrides), now)
+		if tc.path == "" {
+			if !res.OK {
+				t.Errorf("%s: issues = %+v, want none", name, res.Issues)
+			}
+			continue
+		}
+		if len(res.Issues) != 1 || res.Issues[0].Code != "EPOCH_MISALIGNED" || res.Issues[0].Path != tc.path {
+			t.Errorf("%s: issues = %+v, want EPOCH_MISALIGNED at %s", name, res.Issues, tc.path)
+		}
+	}
+
+	res := v.validate(testPacket(t, now, map[string]any{"generation": 4, "epoch_start": start}), now)
+	if want := now.Add(-time.Hour).Format(time.RFC3339); !strings.HasSuffix(res.Issues[0].Message, "is "+want) {
+		t.Errorf("message %q does not give the expected instant %s", res.Issues[0].Message, want)
+	}
+}
+
+func TestResultStream(t *testing.T) {
+	results := []Result{
+		{Packet: "stdin[0]", OK: true, Issues: []Issue{}, packet: map[string]any{"context_id": "a", "payload": strings.Repeat("x", 1024)}},
+		{Packet: "stdin[1]", Issues: []Issue{{Code: "TIME_EXPIRED", Path: "/expires_at"}}, packet: map[string]any{"context_id": "b", "parent_id": "a"}},
+	}
+	var buf bytes.Buffer
+	streamed := batchReport{OK: true, Results: []Result{}, stream: newResultStream(&buf), keepLinks: true}
+	buffered := batchReport{OK: true, Results: []Result{}}
+	for _, r := range results {
+		streamed.add(r)
+		buffered.add(r)
+		if !strings.Contains(buf.String(), `"packet": "`+r.Packet+`"`) {
+			t.Fatalf("%s not written once added:\n%s", r.Packet, buf.String())
+		}
+	}
+	if len(streamed.Results) != 2 || len(streamed.Results[0].packet) != 2 || len(streamed.Results[0].Issues) != 0 {
+		t.Errorf("streamed report kept %+v, want only link ids", streamed.Results)
+	}
+	streamed.Issues = []Issue{{Code: "MAX_PACKETS", Severity: severityInfo}}
+	buffered.Issues = streamed.Issues
+	streamed.stream.close(&streamed)
+
+	var got, want any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("streamed output is not JSON: %v\n%s", err, buf.String())
+	}
+	var plain bytes.Buffer
+	writeReport(&plain, buffered)
+	json.Unmarshal(plain.Bytes(), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("streamed report:\n%s\nwant:\n%s", buf.String(), plain.String())
+	}
+	if sum, want := streamed.summary(), buffered.summary(); !reflect.DeepEqual(sum, want) {
+		t.Errorf("streamed summary = %+v, want %+v", sum, want)
+	}
+}
+
+func TestIssueTemplate(t *testing.T) {
+	if _, err := parseIssueTemplate("{{.Cod}}"); err == nil {
+		t.Error("template with an unknown field parsed")
+	}
+	tmpl, err := parseIssueTemplate("{{.Packet}} {{.ContextID}} {{.Code}}{{with .Path}} at {{.}}{{end}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := batchReport{Results: []Result{
+		{Packet: "a.json", Issues: []Issue{{Code: "TIME_EXPIRED", Path: "/expires_at"}}, packet: map[string]any{"context_id": "ctx_a"}},
+		{Packet: "b.json", OK: true, Issues: []Issue{}},
+	}, Issues: []Issue{{Code: "MAX_PACKETS", Severity: severityInfo}}}
+	var buf bytes.Buffer
+	if err := writeIssues(&buf, tmpl, report); err != nil {
+		t.Fatal(err)
+	}
+	if want := "a.json ctx_a TIME_EXPIRED at /expires_at\n  MAX_PACKETS\n"; buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestSignatureAlgKeyMismatch(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaDER, err := x509.MarshalPKIXPublicKey(&rsaPriv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	v := testValidator(t)
+	signed := func(alg string, pub []byte) []byte {
+		var packet map[string]any
+		if err := json.Unmarshal(testPacket(t, now, map[string]any{"alg": alg}), &packet); err != nil {
+			t.Fatal(err)
+		}
+		canonical, err := canonicalJSON(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(edPriv, canonical))
+		packet["public_key_id"] = base64.StdEncoding.EncodeToString(pub)
+		b, err := json.Marshal(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	for name, tc := range map[string]struct {
+		alg  string
+		pub  []byte
+		code string
+	}{
+		"ed25519":                {"Ed25519", edPub, ""},
+		"unchecked alg":          {"ES256", edPub, ""},
+		"rsa alg, ed25519 key":   {"RS256", edPub, "SIGNATURE_ALG_KEY_MISMATCH"},
+		"ed25519 alg, rsa key":   {"EdDSA", rsaDER, "SIGNATURE_ALG_KEY_MISMATCH"},
+		"rsa alg, pkcs1 rsa key": {"PS256", x509.MarshalPKCS1PublicKey(&rsaPriv.PublicKey), "INTEGRITY_FAILURE"},
+	} {
+		res := v.validate(signed(tc.alg, tc.pub), now)
+		got := ""
+		if len(res.Issues) > 0 {
+			got = res.Issues[0].Code
+		}
+		if got != tc.code || len(res.Issues) > 1 {
+			t.Errorf("%s: issues = %+v, want %q", name, res.Issues, tc.code)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CB_ENV", "staging")
+	for in, want := range map[string]string{
+		"schemas/${CB_ENV}/s.json": "schemas/staging/s.json",
+		"cost$5/$CB_ENV.json":      "cost$5/$CB_ENV.json",
+		"lit/$${CB_UNSET}.json":    "lit/${CB_UNSET}.json",
+		"mix/$${CB_ENV}-${CB_ENV}": "mix/${CB_ENV}-staging",
+	} {
+		if got, err := expandEnv(in); err != nil || got != want {
+			t.Errorf("expandEnv(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := expandEnv("${CB_UNSET}/s.json"); err == nil || !strings.Contains(err.Error(), "CB_UNSET") {
+		t.Errorf("unset variable: err = %v, want one naming CB_UNSET", err)
+	}
+}
+
+func TestResolveSkews(t *testing.T) {
+	for name, tc := range map[string]struct {
+		skew, expiry, future, allowFuture string
+		allowFutureSet                    bool
+		wantExpiry, wantFuture            time.Duration
+	}{
+		"defaults":                {"", "", "", "5m", false, time.Minute, 5 * time.Minute},
+		"skew alone":              {"2m", "", "", "5m", false, 2 * time.Minute, 2 * time.Minute},
+		"skew and future-skew":    {"2m", "", "30s", "5m", false, 2 * time.Minute, 30 * time.Second},
+		"skew and expiry-skew":    {"2m", "10m", "", "5m", false, 10 * time.Minute, 2 * time.Minute},
+		"skew and allow-future":   {"2m", "", "", "1h", true, 2 * time.Minute, time.Hour},
+		"allow-future at default": {"2m", "", "", "5m", true, 2 * time.Minute, 5 * time.Minute},
+	} {
+		expiry, future, err := resolveSkews(time.Minute, tc.skew, tc.expiry, tc.future, tc.allowFuture, tc.allowFutureSet)
+		if err != nil || expiry != tc.wantExpiry || future != tc.wantFuture {
+			t.Errorf("%s: expiry=%v future=%v err=%v, want %v and %v", name, expiry, future, err, tc.wantExpiry, tc.wantFuture)
+		}
+	}
+	if _, _, err := resolveSkews(time.Minute, "", "", "30s", "1h", true); err == nil {
+		t.Error("--future-skew with --allow-future-created-at accepted")
+	}
+	if _, _, err := resolveSkews(time.Minute, "soon", "", "", "5m", false); err == nil {
+		t.Error("malformed --skew accepted")
+	}
+}
+
+func TestMetadataKeyPatternAlone(t *testing.T) {
+	if field, re, err := parseMetadataCheck("", `^[a-z_]+$`, false); field != "" || re != nil || err != nil {
+		t.Errorf("defaults: field=%q re=%v err=%v, want the check off", field, re, err)
+	}
+	field, re, err := parseMetadataCheck("", `^[a-z_]+$`, true)
+	if err != nil || field != "metadata" {
+		t.Fatalf("pattern alone: field=%q err=%v, want metadata", field, err)
+	}
+	now := time.Now().UTC()
+	v := testValidator(t)
+	v.metadataField, v.metadataKeyRe = field, re
+	res := v.validate(testPacket(t, now, map[string]any{"metadata": map[string]any{"camelCase": 1}}), now)
+	if res.OK || len(res.Issues) != 1 || res.Issues[0].Code != "METADATA_KEY_INVALID" {
+		t.Errorf("issues = %+v, want METADATA_KEY_INVALID", res.Issues)
+	}
+}